@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kong"
@@ -33,28 +37,124 @@ type ResolverConfig struct {
 	InHost      string `help:"Hostname to be used for the CNAME record." default:"in.srd.sh"`
 	ToolboxHost string `help:"Hostname to be used for the toolbox route." default:"srd.sh"`
 
-	TTL             time.Duration `help:"Cache TTL in seconds." default:"300s"`
+	AllowedSchemes  []string `help:"Destination URL schemes records may redirect to." default:"http,https" sep:","`
+	StrictRecords   bool     `help:"Treat records with invalid field values, e.g. code=310, as invalid instead of using the field's default." default:"false"`
+	InspectorStrict bool     `help:"Treat records with invalid field values as invalid in the inspector." default:"true" negatable:""`
+
+	TTL             time.Duration `help:"Cache TTL in seconds, used when the DNS TTL is unknown." default:"300s"`
+	MinTTL          time.Duration `help:"Minimum cache TTL in seconds, DNS TTLs below this are raised." default:"30s"`
+	MaxTTL          time.Duration `help:"Maximum cache TTL in seconds, DNS TTLs above this are lowered." default:"3600s"`
+	NegativeTTL     time.Duration `help:"Cache TTL in seconds for missing and invalid records, lowered to the zone's SOA negative TTL." default:"60s"`
+	StaleWindow     time.Duration `help:"How long past expiry a record is served when DNS lookups fail, 0 to disable." default:"86400s"`
 	CleanupInterval time.Duration `help:"Cache cleanup interval in seconds." default:"900s"`
+	SlidingExpiry   bool          `help:"Extend a cached record's TTL each time it is used instead of expiring it a fixed TTL after lookup." default:"false"`
+	CacheMaxEntries int           `help:"Maximum number of cached hosts, least recently used hosts are evicted beyond it. 0 for unbounded." default:"100000"`
+	CacheMaxBytes   int64         `help:"Approximate maximum cache size in bytes, least recently used hosts are evicted beyond it. 0 for unbounded." default:"0"`
+
+	PrefetchHits        int `help:"Uses of a cached record before it is refreshed in the background when close to expiring, 0 to disable." default:"10"`
+	PrefetchConcurrency int `help:"Maximum number of background prefetches in flight." default:"4"`
+
+	Upstreams           []string      `help:"Upstream DNS servers for TXT lookups, e.g. 10.0.0.53 or 10.0.0.53:5353, DNS over TLS servers, e.g. tls://dns.example or tls://10.0.0.53#dns.example, or DNS over HTTPS endpoints, e.g. https://dns.example/dns-query. Uses the system resolver when empty." sep:","`
+	QueryTimeout        time.Duration `help:"Per-query timeout for upstream DNS servers." default:"500ms"`
+	QueryRetries        int           `help:"Number of times the upstream DNS servers are retried." default:"1"`
+	HedgeDelay          time.Duration `help:"How long a query waits for an upstream DNS server before it is also sent to the next one, 0 to wait for the server to fail." default:"0s"`
+	CircuitThreshold    int           `help:"Consecutive failures after which an upstream DNS server is only tried after the others, -1 to disable." default:"5"`
+	CircuitCooldown     time.Duration `help:"How often an upstream DNS server with an open circuit is probed." default:"30s"`
+	DoHMethod           string        `help:"HTTP method for DNS over HTTPS queries, GET or POST." default:"GET" enum:"GET,POST" name:"doh-method"`
+	Bootstrap           []string      `help:"DNS servers used to resolve the hostnames of DNS over TLS and DNS over HTTPS upstreams. Uses the system resolver when empty." sep:","`
+	SPKIPins            []string      `help:"Base64 SHA-256 hashes of the public keys DNS over TLS upstreams may present. When set, upstreams are authenticated by their key alone." sep:"," name:"spki-pins"`
+	UpstreamIdleTimeout time.Duration `help:"How long DNS over TLS and DNS over HTTPS connections are kept open without queries." default:"30s"`
+	TrustAD             bool          `help:"Trust the upstream DNS servers to validate DNSSEC, using their AD bit and refusing bogus answers. Only enable for validating servers reached over a trusted path." default:"false"`
+	RequireSecure       bool          `help:"Refuse records that are not DNSSEC secure. Requires trust-ad and upstreams." default:"false"`
+
+	LookupTimeout time.Duration `help:"Timeout for a TXT lookup shared by concurrent requests for the same host." default:"5s"`
+
+	Peers       []string      `help:"Base URLs of all SRD replicas sharing resolved records, including this one, e.g. http://10.0.0.2:8082. Requires the peer server." sep:","`
+	PeerSelf    string        `help:"This replica's URL as it appears in peers."`
+	PeerTimeout time.Duration `help:"Timeout for requests to other peers." default:"2s"`
+
+	SnapshotPath     string        `help:"File the cache is saved to on shutdown and loaded from on startup. Empty to disable." default:""`
+	SnapshotInterval time.Duration `help:"How often the cache is also saved while running, 0 to save only on shutdown." default:"300s"`
 }
 
 func (s *ServeCmd) Run(ctx *Context) error {
 	glog.NewLogger(s.Log.Level)
 
+	// without trusted upstreams no record is ever secure, every record would be refused
+	if s.Resolver.RequireSecure && (!s.Resolver.TrustAD || len(s.Resolver.Upstreams) == 0) {
+		return fmt.Errorf("--resolver.require-secure requires --resolver.trust-ad and --resolver.upstreams")
+	}
+
+	var lookuper resolver.TXTLookuper
+	if len(s.Resolver.Upstreams) > 0 {
+		client, err := resolver.NewDNSClient(resolver.DNSClientConfig{
+			Servers:          s.Resolver.Upstreams,
+			Timeout:          s.Resolver.QueryTimeout,
+			Retries:          s.Resolver.QueryRetries,
+			TrustAD:          s.Resolver.TrustAD,
+			DoHMethod:        s.Resolver.DoHMethod,
+			Bootstrap:        s.Resolver.Bootstrap,
+			SPKIPins:         s.Resolver.SPKIPins,
+			IdleTimeout:      s.Resolver.UpstreamIdleTimeout,
+			HedgeDelay:       s.Resolver.HedgeDelay,
+			CircuitThreshold: s.Resolver.CircuitThreshold,
+			CircuitCooldown:  s.Resolver.CircuitCooldown,
+			Logger:           glog.GetLogger(),
+		})
+
+		if err != nil {
+			return fmt.Errorf("failed to init dns client: %w", err)
+		}
+		defer client.Close()
+
+		lookuper = client
+	}
+
 	rp, err := resolver.New(resolver.ResolverConfig{
-		RecordPrefix:       s.Resolver.RecordPrefix,
-		NoHostBaseRedirect: s.Resolver.NoHostBaseRedirect,
-		InHost:             s.Resolver.InHost,
-		ToolboxHost:        s.Resolver.ToolboxHost,
-		TTL:                s.Resolver.TTL,
-		CleanupInterval:    s.Resolver.CleanupInterval,
-		Logger:             glog.GetLogger(),
+		RecordPrefix:        s.Resolver.RecordPrefix,
+		NoHostBaseRedirect:  s.Resolver.NoHostBaseRedirect,
+		InHost:              s.Resolver.InHost,
+		ToolboxHost:         s.Resolver.ToolboxHost,
+		AllowedSchemes:      s.Resolver.AllowedSchemes,
+		StrictRecords:       s.Resolver.StrictRecords,
+		RequireSecure:       s.Resolver.RequireSecure,
+		InspectorLenient:    !s.Resolver.InspectorStrict,
+		TTL:                 s.Resolver.TTL,
+		MinTTL:              s.Resolver.MinTTL,
+		MaxTTL:              s.Resolver.MaxTTL,
+		NegativeTTL:         s.Resolver.NegativeTTL,
+		LookupTimeout:       s.Resolver.LookupTimeout,
+		StaleWindow:         s.Resolver.StaleWindow,
+		PrefetchHits:        s.Resolver.PrefetchHits,
+		PrefetchConcurrency: s.Resolver.PrefetchConcurrency,
+		CleanupInterval:     s.Resolver.CleanupInterval,
+		SlidingExpiry:       s.Resolver.SlidingExpiry,
+		CacheMaxEntries:     s.Resolver.CacheMaxEntries,
+		CacheMaxBytes:       s.Resolver.CacheMaxBytes,
+		SnapshotPath:        s.Resolver.SnapshotPath,
+		SnapshotInterval:    s.Resolver.SnapshotInterval,
+		Peers:               s.Resolver.Peers,
+		PeerSelf:            s.Resolver.PeerSelf,
+		PeerTimeout:         s.Resolver.PeerTimeout,
+		Lookuper:            lookuper,
+		Logger:              glog.GetLogger(),
 	})
 
 	if err != nil {
 		return fmt.Errorf("failed to init resolver: %w", err)
 	}
 
-	server.Start(s.Server, rp, glog.GetLogger())
+	sctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// the servers are shut down first, so the snapshot saved by Close has their last records
+	if err := server.Start(sctx, s.Server, rp, glog.GetLogger()); err != nil {
+		glog.GetLogger().Error("failed to shut down servers", "error", err)
+	}
+
+	if err := rp.Close(); err != nil {
+		return fmt.Errorf("failed to close resolver: %w", err)
+	}
 
 	return nil
 }
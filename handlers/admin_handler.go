@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/twopow/srd/resolver"
+)
+
+// InvalidateHandler drops the cached record for the hostname in the query,
+// e.g. once a customer fixed their record. It must only be reachable by operators
+func InvalidateHandler(resv resolver.ResolverProvider) http.HandlerFunc {
+	log := resv.Logger()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		hostname := r.URL.Query().Get("hostname")
+		if hostname == "" {
+			http.Error(w, "hostname is required", http.StatusBadRequest)
+			return
+		}
+
+		l := log.With("hostname", hostname)
+
+		hostname, err := resolver.NormalizeHostname(hostname)
+		if errors.Is(err, resolver.ErrHostIsIp) {
+			l.Debug("invalidate: ip address not allowed")
+			http.Error(w, "ip address not allowed", http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			l.Debug("invalidate: invalid hostname", "error", err)
+			http.Error(w, "invalid hostname", http.StatusBadRequest)
+			return
+		}
+
+		resv.Invalidate(hostname)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
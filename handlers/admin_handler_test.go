@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/twopow/srd/resolver"
+)
+
+func TestInvalidateHandler(t *testing.T) {
+	tests := []struct {
+		name            string
+		path            string
+		wantStatus      int
+		wantInvalidated []string
+	}{
+		{name: "hostname", path: "/invalidate?hostname=Success.test.", wantStatus: http.StatusNoContent, wantInvalidated: []string{"success.test"}},
+		{name: "missing hostname", path: "/invalidate", wantStatus: http.StatusBadRequest},
+		{name: "ip", path: "/invalidate?hostname=192.0.2.1", wantStatus: http.StatusBadRequest},
+		{name: "invalid hostname", path: "/invalidate?hostname=-invalid.test", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := resolver.Mock().(*resolver.MockResolver)
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			rr := httptest.NewRecorder()
+			InvalidateHandler(mock).ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, tt.wantStatus)
+			}
+
+			if !slices.Equal(mock.Invalidated, tt.wantInvalidated) {
+				t.Errorf("invalidated = %v, want %v", mock.Invalidated, tt.wantInvalidated)
+			}
+		})
+	}
+}
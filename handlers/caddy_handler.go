@@ -2,9 +2,9 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"net/http"
 
-	"github.com/twopow/srd/internal/util"
 	"github.com/twopow/srd/resolver"
 )
 
@@ -22,12 +22,19 @@ func CaddyHelperHandler(resv resolver.ResolverProvider) http.HandlerFunc {
 
 		l := log.With("domain", domain)
 
-		if util.IsIp(domain) {
+		domain, err := resolver.NormalizeHostname(domain)
+		if errors.Is(err, resolver.ErrHostIsIp) {
 			l.Debug("caddy domain check: ip address not allowed")
 			http.Error(w, "ip address not allowed", http.StatusBadRequest)
 			return
 		}
 
+		if err != nil {
+			l.Debug("caddy domain check: invalid domain", "error", err)
+			http.Error(w, "invalid domain", http.StatusBadRequest)
+			return
+		}
+
 		if inHost != "" && domain == inHost {
 			l.Debug("caddy domain check: is in host")
 			w.WriteHeader(http.StatusOK)
@@ -44,7 +51,14 @@ func CaddyHelperHandler(resv resolver.ResolverProvider) http.HandlerFunc {
 			return
 		}
 
-		l.Debug("caddy domain check: rejected")
+		// a lookup failure says nothing about the domain, tell it apart from a rejection
+		if resolveErrorStatus(err) == http.StatusServiceUnavailable {
+			l.Warn("caddy domain check: lookup failed", "error", err)
+			http.Error(w, "lookup failed", http.StatusServiceUnavailable)
+			return
+		}
+
+		l.Debug("caddy domain check: rejected", "error", err)
 		http.Error(w, "rejected", http.StatusBadRequest)
 	}
 }
@@ -55,6 +55,22 @@ func TestCaddyHandler_NotFound(t *testing.T) {
 	})
 }
 
+func TestCaddyHandler_InvalidRecord(t *testing.T) {
+	doCaddyHandlerTest(t, CaddyHandlerTestData{
+		Path:           "/ask?domain=invalid.test",
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   "rejected",
+	})
+}
+
+func TestCaddyHandler_DNSFailure(t *testing.T) {
+	doCaddyHandlerTest(t, CaddyHandlerTestData{
+		Path:           "/ask?domain=dns-failure.test",
+		ExpectedStatus: http.StatusServiceUnavailable,
+		ExpectedBody:   "lookup failed",
+	})
+}
+
 func TestCaddyHandler_Ip(t *testing.T) {
 	doCaddyHandlerTest(t, CaddyHandlerTestData{
 		Path:           "/ask?domain=127.0.0.1",
@@ -63,6 +79,30 @@ func TestCaddyHandler_Ip(t *testing.T) {
 	})
 }
 
+func TestCaddyHandler_IPv6(t *testing.T) {
+	doCaddyHandlerTest(t, CaddyHandlerTestData{
+		Path:           "/ask?domain=%5B::1%5D:8888",
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   "ip address not allowed",
+	})
+}
+
+func TestCaddyHandler_InvalidDomain(t *testing.T) {
+	doCaddyHandlerTest(t, CaddyHandlerTestData{
+		Path:           "/ask?domain=-bad.test",
+		ExpectedStatus: http.StatusBadRequest,
+		ExpectedBody:   "invalid domain",
+	})
+}
+
+func TestCaddyHandler_TrailingDot(t *testing.T) {
+	doCaddyHandlerTest(t, CaddyHandlerTestData{
+		Path:           "/ask?domain=success.test.",
+		ExpectedStatus: http.StatusOK,
+		ExpectedBody:   "ok",
+	})
+}
+
 func TestCaddyHandler_IpPort(t *testing.T) {
 	doCaddyHandlerTest(t, CaddyHandlerTestData{
 		Path:           "/ask?domain=127.0.0.1:8888",
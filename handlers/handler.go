@@ -34,18 +34,24 @@ func ResolveHandler(resolver resolverP.ResolverProvider) http.HandlerFunc {
 			return
 		}
 
-		if r.Host == "" || util.IsIp(r.Host) {
+		if r.Host == "" {
 			handleResolveError(w, r, resolver, resolverP.ErrHostIsIp)
 			return
 		}
 
-		value, err := resolver.Resolve(ctx, r.Host)
+		host, err := resolverP.NormalizeHostname(r.Host)
 		if err != nil {
 			handleResolveError(w, r, resolver, err)
 			return
 		}
 
-		l := log.With("request", rid, "from", r.Host, "to", value.To)
+		value, err := resolver.Resolve(ctx, host)
+		if err != nil {
+			handleResolveError(w, r, resolver, err)
+			return
+		}
+
+		l := log.With("request", rid, "from", r.Host, "to", value.To, "stale", value.Stale)
 
 		if value.NotFound {
 			l.Info("not found")
@@ -102,15 +108,53 @@ func handleResolveError(w http.ResponseWriter, r *http.Request, resolver resolve
 		return
 	}
 
-	log.Error("resolve error", "error", err)
-
-	// Context timeouts/cancellations are distinguishable:
-	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
-		http.Error(w, "timeout", http.StatusInternalServerError)
-		return
+	status := resolveErrorStatus(err)
+
+	var invalid *resolverP.InvalidRecordError
+
+	switch {
+	case errors.Is(err, resolverP.ErrInvalidHostname):
+		log.Info("invalid hostname", "error", err)
+		http.Error(w, "invalid hostname", status)
+	case errors.Is(err, resolverP.ErrNoRecord):
+		log.Info("not found")
+		http.Error(w, "Not found", status)
+	case errors.As(err, &invalid):
+		log.Warn("invalid record", "error", err)
+		http.Error(w, "invalid srd record: "+invalid.Err.Error(), status)
+	case status == http.StatusServiceUnavailable:
+		log.Error("resolve error", "error", err)
+
+		if errors.Is(err, resolverP.ErrDNSFailure) {
+			http.Error(w, "dns resolution failed", status)
+		} else {
+			http.Error(w, "timeout", status)
+		}
+	default:
+		log.Error("resolve error", "error", err)
+		http.Error(w, "internal server error", status)
 	}
+}
 
-	http.Error(w, "internal server error", http.StatusInternalServerError)
+// resolveErrorStatus maps a resolve error to the status code from rfc.md section 4.3
+func resolveErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, resolverP.ErrInvalidHostname):
+		return http.StatusBadRequest
+	case errors.Is(err, resolverP.ErrNoRecord):
+		return http.StatusNotFound
+	case errors.Is(err, resolverP.ErrInvalidRecord):
+		return http.StatusInternalServerError
+	case errors.Is(err, resolverP.ErrLoop):
+		return http.StatusLoopDetected
+	case errors.Is(err, resolverP.ErrDNSFailure),
+		errors.Is(err, resolverP.ErrTimeout),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
 }
 
 func isInspectRequest(r *http.Request, cfg *resolverP.ResolverConfig) bool {
@@ -118,11 +162,16 @@ func isInspectRequest(r *http.Request, cfg *resolverP.ResolverConfig) bool {
 		return false
 	}
 
-	if r.Host == "" || util.IsIp(r.Host) {
+	if r.Host == "" {
+		return true
+	}
+
+	host, err := resolverP.NormalizeHostname(r.Host)
+	if errors.Is(err, resolverP.ErrHostIsIp) {
 		return true
 	}
 
-	return cfg.InHost != "" && r.Host == cfg.InHost
+	return cfg.InHost != "" && err == nil && host == cfg.InHost
 }
 
 func constructTo(r *http.Request, value resolverP.RR) (*url.URL, error) {
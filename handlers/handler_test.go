@@ -143,6 +143,33 @@ func TestResolveHandler_Error(t *testing.T) {
 	})
 }
 
+func TestResolveHandler_InvalidRecord(t *testing.T) {
+	doResolverTest(t, TestData{
+		Hostname:       "invalid.test",
+		Path:           "/",
+		ExpectedBody:   "invalid srd record: no destination found",
+		ExpectedStatus: http.StatusInternalServerError,
+	})
+}
+
+func TestResolveHandler_DNSFailure(t *testing.T) {
+	doResolverTest(t, TestData{
+		Hostname:       "dns-failure.test",
+		Path:           "/",
+		ExpectedBody:   "dns resolution failed",
+		ExpectedStatus: http.StatusServiceUnavailable,
+	})
+}
+
+func TestResolveHandler_Timeout(t *testing.T) {
+	doResolverTest(t, TestData{
+		Hostname:       "timeout.test",
+		Path:           "/",
+		ExpectedBody:   "timeout",
+		ExpectedStatus: http.StatusServiceUnavailable,
+	})
+}
+
 func TestResolveHandler_NoHostBaseRedirect(t *testing.T) {
 	doResolverTest(t, TestData{
 		Hostname:       "127.0.0.1:8080",
@@ -152,6 +179,46 @@ func TestResolveHandler_NoHostBaseRedirect(t *testing.T) {
 	})
 }
 
+func TestResolveHandler_NoHostBaseRedirect_IPv6(t *testing.T) {
+	doResolverTest(t, TestData{
+		Hostname:       "[::1]:8080",
+		Path:           "/",
+		ExpectedStatus: http.StatusFound,
+		ExpectedTo:     "https://github.com/twopow/srd",
+	})
+}
+
+func TestResolveHandler_NormalizesHost(t *testing.T) {
+	for _, host := range []string{"success.test:8080", "success.test.", "SUCCESS.test.:443"} {
+		doResolverTest(t, TestData{
+			Hostname:       host,
+			Path:           "/",
+			ExpectedStatus: http.StatusFound,
+			ExpectedTo:     "http://to.test",
+		})
+	}
+}
+
+func TestResolveHandler_IDN(t *testing.T) {
+	for _, host := range []string{"bücher.test", "BÜCHER.test.", "xn--bcher-kva.test"} {
+		doResolverTest(t, TestData{
+			Hostname:       host,
+			Path:           "/",
+			ExpectedStatus: http.StatusFound,
+			ExpectedTo:     "https://xn--caf-dma.test/Menu",
+		})
+	}
+}
+
+func TestResolveHandler_InvalidHost(t *testing.T) {
+	doResolverTest(t, TestData{
+		Hostname:       "bad_host.test",
+		Path:           "/",
+		ExpectedBody:   "invalid hostname",
+		ExpectedStatus: http.StatusBadRequest,
+	})
+}
+
 func TestResolveHandler_RefererPolicy_DefaultIsHost(t *testing.T) {
 	doResolverTest(t, TestData{
 		Hostname:       "success-referer-policy-default.test",
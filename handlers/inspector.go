@@ -16,8 +16,43 @@ type InspectResponse struct {
 	PreserveRoute bool   `json:"preserve_route,omitempty"`
 	RefererPolicy string `json:"referer_policy,omitempty"`
 	NotFound      bool   `json:"not_found,omitempty"`
+	Stale         bool   `json:"stale,omitempty"`
 	Loop          bool   `json:"loop,omitempty"`
 	Error         string `json:"error,omitempty"`
+
+	// HostUnicode and DestinationUnicode are the Unicode forms of
+	// Host and Destination when they are internationalized
+	HostUnicode        string `json:"host_unicode,omitempty"`
+	DestinationUnicode string `json:"destination_unicode,omitempty"`
+
+	// Record is the canonical form of the host's srd record
+	Record string `json:"record,omitempty"`
+
+	// DNSSEC is the validation status of the host's srd record when the
+	// upstream servers are trusted to validate it
+	DNSSEC string `json:"dnssec,omitempty"`
+
+	// Warnings are the problems with the record that don't make it invalid
+	Warnings []string `json:"warnings,omitempty"`
+
+	// MultipleRecords is set when the host publishes more than one srd record
+	MultipleRecords bool `json:"multiple_records,omitempty"`
+
+	// Status is the status code a request for the host gets when it can't be redirected
+	Status int `json:"status,omitempty"`
+
+	// Upstreams is the health of the upstream DNS servers, when the resolver tracks it
+	Upstreams []InspectUpstream `json:"upstreams,omitempty"`
+}
+
+type InspectUpstream struct {
+	Server      string  `json:"server"`
+	LatencyMs   float64 `json:"latency_ms"`
+	ErrorRate   float64 `json:"error_rate"`
+	Queries     uint64  `json:"queries"`
+	Failures    uint64  `json:"failures"`
+	CircuitOpen bool    `json:"circuit_open,omitempty"`
+	LastError   string  `json:"last_error,omitempty"`
 }
 
 func HandleInspect(ctx context.Context, w http.ResponseWriter, r *http.Request, resolver resolverP.ResolverProvider) error {
@@ -32,17 +67,53 @@ func HandleInspect(ctx context.Context, w http.ResponseWriter, r *http.Request,
 		return json.NewEncoder(w).Encode(InspectResponse{Error: "missing required query parameter: host"})
 	}
 
-	rr, err := resolver.Resolve(ctx, host)
+	// the resolver rejects hosts that can't be normalized
+	if normalized, err := resolverP.NormalizeHostname(host); err == nil {
+		host = normalized
+	}
+
+	inspection, err := resolver.Inspect(ctx, host)
+	rr := inspection.RR
 
 	resp := InspectResponse{
-		Host:     host,
-		NotFound: rr.NotFound,
+		Host:        host,
+		HostUnicode: unicodeForm(host, resolverP.UnicodeHostname(host)),
+		NotFound:    rr.NotFound,
+		Stale:       rr.Stale,
+	}
+
+	if rr.Security != resolverP.SecurityUnknown {
+		resp.DNSSEC = rr.Security.String()
+	}
+
+	for _, w := range inspection.Warnings {
+		resp.Warnings = append(resp.Warnings, w.String())
+	}
+
+	for _, u := range resolver.Upstreams() {
+		resp.Upstreams = append(resp.Upstreams, InspectUpstream{
+			Server:      u.Server,
+			LatencyMs:   float64(u.Latency.Microseconds()) / 1000,
+			ErrorRate:   u.ErrorRate,
+			Queries:     u.Queries,
+			Failures:    u.Failures,
+			CircuitOpen: u.CircuitOpen,
+			LastError:   u.LastError,
+		})
 	}
 
 	if err != nil {
-		if errors.Is(err, resolverP.ErrLoop) {
+		resp.Status = resolveErrorStatus(err)
+
+		switch {
+		case errors.Is(err, resolverP.ErrLoop):
 			resp.Loop = true
-		} else {
+		case errors.Is(err, resolverP.ErrNoRecord):
+			resp.NotFound = true
+		case errors.Is(err, resolverP.ErrMultipleRecords):
+			resp.MultipleRecords = true
+			resp.Error = err.Error()
+		default:
 			resp.Error = err.Error()
 		}
 	}
@@ -52,7 +123,18 @@ func HandleInspect(ctx context.Context, w http.ResponseWriter, r *http.Request,
 		resp.Code = rr.Code
 		resp.PreserveRoute = rr.PreserveRoute
 		resp.RefererPolicy = rr.RefererPolicy.String()
+		resp.Record = rr.Record()
+		resp.DestinationUnicode = unicodeForm(rr.To, rr.UnicodeTo())
 	}
 
 	return json.NewEncoder(w).Encode(resp)
 }
+
+// unicodeForm returns unicode when it differs from ascii, so it is only shown for internationalized names
+func unicodeForm(ascii, unicode string) string {
+	if unicode == ascii {
+		return ""
+	}
+
+	return unicode
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/twopow/srd/resolver"
@@ -89,6 +90,21 @@ func TestInspect_RefererPolicy(t *testing.T) {
 		if resp.RefererPolicy != "full" {
 			t.Fatalf("expected referer_policy full, got %s", resp.RefererPolicy)
 		}
+		if resp.Record != "v=srd1; dest=https://to.test/path?query=string; referer=full" {
+			t.Fatalf("expected canonical record, got %s", resp.Record)
+		}
+	})
+}
+
+func TestInspect_Stale(t *testing.T) {
+	doInspectTest(t, "host=success-stale.test", func(t *testing.T, code int, resp InspectResponse) {
+		if !resp.Stale {
+			t.Fatalf("expected stale to be true")
+		}
+
+		if resp.Destination != "https://to.test/path?query=string" {
+			t.Fatalf("expected destination of stale record, got %s", resp.Destination)
+		}
 	})
 }
 
@@ -134,3 +150,125 @@ func TestInspect_ResolveError(t *testing.T) {
 	})
 }
 
+func TestInspect_InvalidRecord(t *testing.T) {
+	doInspectTest(t, "host=invalid.test", func(t *testing.T, code int, resp InspectResponse) {
+		if code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", code)
+		}
+		if resp.Status != http.StatusInternalServerError {
+			t.Fatalf("expected status 500, got %d", resp.Status)
+		}
+		if resp.Error != "invalid srd record: no destination found" {
+			t.Fatalf("expected invalid record reason, got %s", resp.Error)
+		}
+	})
+}
+
+func TestInspect_DNSFailure(t *testing.T) {
+	doInspectTest(t, "host=dns-failure.test", func(t *testing.T, code int, resp InspectResponse) {
+		if code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", code)
+		}
+		if resp.Status != http.StatusServiceUnavailable {
+			t.Fatalf("expected status 503, got %d", resp.Status)
+		}
+		if resp.Error == "" {
+			t.Fatal("expected error message")
+		}
+	})
+}
+
+func TestInspect_Warnings(t *testing.T) {
+	doInspectTest(t, "host=warnings.test", func(t *testing.T, code int, resp InspectResponse) {
+		if code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", code)
+		}
+		if len(resp.Warnings) != 1 || resp.Warnings[0] != `column 35: invalid code "310", allowed values are 301, 302, 307 and 308, using 302` {
+			t.Fatalf("expected code warning, got %v", resp.Warnings)
+		}
+		if resp.Destination != "https://to.test" {
+			t.Fatalf("expected destination https://to.test, got %s", resp.Destination)
+		}
+	})
+}
+
+func TestInspect_IDN(t *testing.T) {
+	for _, host := range []string{"bücher.test", "xn--bcher-kva.test"} {
+		doInspectTest(t, "host="+url.QueryEscape(host), func(t *testing.T, code int, resp InspectResponse) {
+			if resp.Host != "xn--bcher-kva.test" {
+				t.Fatalf("expected host xn--bcher-kva.test, got %s", resp.Host)
+			}
+			if resp.HostUnicode != "bücher.test" {
+				t.Fatalf("expected host_unicode bücher.test, got %s", resp.HostUnicode)
+			}
+			if resp.Destination != "https://xn--caf-dma.test/Menu" {
+				t.Fatalf("expected ascii destination, got %s", resp.Destination)
+			}
+			if resp.DestinationUnicode != "https://café.test/Menu" {
+				t.Fatalf("expected destination_unicode https://café.test/Menu, got %s", resp.DestinationUnicode)
+			}
+		})
+	}
+
+	doInspectTest(t, "host=success.test", func(t *testing.T, code int, resp InspectResponse) {
+		if resp.HostUnicode != "" || resp.DestinationUnicode != "" {
+			t.Fatalf("expected no unicode forms, got %s and %s", resp.HostUnicode, resp.DestinationUnicode)
+		}
+	})
+}
+
+func TestInspect_DNSSEC(t *testing.T) {
+	doInspectTest(t, "host=dnssec-secure.test", func(t *testing.T, code int, resp InspectResponse) {
+		if resp.DNSSEC != "secure" {
+			t.Fatalf("expected dnssec secure, got %q", resp.DNSSEC)
+		}
+	})
+
+	doInspectTest(t, "host=dnssec-bogus.test", func(t *testing.T, code int, resp InspectResponse) {
+		if resp.DNSSEC != "bogus" {
+			t.Fatalf("expected dnssec bogus, got %q", resp.DNSSEC)
+		}
+		if resp.Status != http.StatusInternalServerError {
+			t.Fatalf("expected status 500, got %d", resp.Status)
+		}
+		if resp.Error == "" {
+			t.Fatal("expected error message")
+		}
+	})
+
+	doInspectTest(t, "host=success.test", func(t *testing.T, code int, resp InspectResponse) {
+		if resp.DNSSEC != "" {
+			t.Fatalf("expected no dnssec status, got %q", resp.DNSSEC)
+		}
+	})
+}
+
+func TestInspect_Upstreams(t *testing.T) {
+	doInspectTest(t, "host=success.test", func(t *testing.T, code int, resp InspectResponse) {
+		if len(resp.Upstreams) != 2 {
+			t.Fatalf("expected 2 upstreams, got %d", len(resp.Upstreams))
+		}
+
+		healthy, open := resp.Upstreams[0], resp.Upstreams[1]
+		if healthy.Server != "10.0.0.53:53" || healthy.LatencyMs != 12 || healthy.CircuitOpen {
+			t.Fatalf("unexpected healthy upstream %+v", healthy)
+		}
+		if open.Server != "tls://10.0.0.54:853" || !open.CircuitOpen || open.LastError != "i/o timeout" || open.Failures != 5 {
+			t.Fatalf("unexpected failing upstream %+v", open)
+		}
+	})
+}
+
+func TestInspect_MultipleRecords(t *testing.T) {
+	doInspectTest(t, "host=multiple.test", func(t *testing.T, code int, resp InspectResponse) {
+		if code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", code)
+		}
+		if !resp.MultipleRecords {
+			t.Fatal("expected multiple_records to be true")
+		}
+		if resp.Status != http.StatusInternalServerError {
+			t.Fatalf("expected status 500, got %d", resp.Status)
+		}
+	})
+}
@@ -1,9 +1,14 @@
 package cache
 
 import (
+	"container/list"
+	"hash/maphash"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/twopow/srd/internal/clock"
 )
 
 type CacheConfig struct {
@@ -13,114 +18,472 @@ type CacheConfig struct {
 	// CleanupInterval is how often to cleanup the cache
 	CleanupInterval time.Duration
 
+	// StaleWindow is how long items are kept past their expiry for GetStale
+	StaleWindow time.Duration
+
+	// Sliding extends an item's expiry by its TTL on every Get,
+	// by default items expire a fixed TTL after they are set
+	Sliding bool
+
+	// MaxEntries is the maximum number of items, the least recently used
+	// items are evicted beyond it. zero means unbounded
+	MaxEntries int
+
+	// MaxBytes is the approximate maximum size of all items, see Sizer.
+	// the least recently used items are evicted beyond it. zero means unbounded
+	MaxBytes int64
+
+	// Shards is the number of independently locked shards, defaults to DefaultShards.
+	// limits are split across shards so they add up to the configured ones, eviction is
+	// least recently used per shard. there are no more shards than MaxEntries
+	Shards int
+
+	// Clock is used for expiry and the cleanup ticker, defaults to clock.Real
+	Clock clock.Clock
+
 	Logger *slog.Logger
 }
 
+// Sizer is implemented by values that know their approximate size in bytes
+type Sizer interface {
+	Size() int
+}
+
+// itemOverhead is the approximate bookkeeping cost of an item in bytes
+const itemOverhead = 64
+
+// DefaultShards is the number of shards used when CacheConfig.Shards is not set
+const DefaultShards = 16
+
+// Stats describe the cache contents and evictions
+type Stats struct {
+	Entries   int
+	Bytes     int64
+	Evictions uint64
+}
+
 var DefaultCacheConfig = CacheConfig{
 	TTL:             time.Second * 300, // 5 minutes
 	CleanupInterval: time.Second * 900, // 15 minutes
 }
 
-type CacheProvider interface {
-	Get(key string) (interface{}, bool)
-	Set(key string, value interface{})
+// Provider is a cache of V values by K keys
+type Provider[K comparable, V any] interface {
+	Get(key K) (V, bool)
+	GetStale(key K) (V, time.Time, bool)
+	Set(key K, value V)
+	SetWithTTL(key K, value V, ttl time.Duration)
+	SetFixed(key K, value V, ttl time.Duration)
+	Delete(key K)
+	Purge()
+	Len() int
+	Range(fn func(key K, value V, expiration time.Time) bool)
 	Cleanup()
+	Stats() Stats
+	Close() error
 }
 
-type item struct {
-	value      interface{}
+// CacheProvider is an untyped cache keyed by string
+type CacheProvider = Provider[string, interface{}]
+
+type item[K comparable, V any] struct {
+	key        K
+	value      V
+	size       int64
+	ttl        time.Duration
 	expiration time.Time
+
+	// fixed items expire after their ttl even when the cache is sliding
+	fixed bool
+
+	// accessed is set by Get, so hits don't need the write lock to track recency.
+	// eviction moves accessed items back to the front instead, as in CLOCK
+	accessed atomic.Bool
+}
+
+// shard is an independently locked part of the cache
+type shard[K comparable, V any] struct {
+	items map[K]*list.Element
+	mu    sync.RWMutex
+
+	// lru orders items from most to least recently set or, once they reach the back, used
+	lru   *list.List
+	bytes int64
+
+	// maxEntries and maxBytes are the shard's share of the limits
+	maxEntries int
+	maxBytes   int64
+
+	// evictions counts all evictions, reported counts those already logged
+	evictions uint64
+	reported  uint64
 }
 
-type Cache struct {
-	items  map[string]item
-	mu     sync.RWMutex
+type Cache[K comparable, V any] struct {
+	shards []*shard[K, V]
+	seed   maphash.Seed
 	config CacheConfig
+
+	// done stops the cleanup goroutine
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-// New creates a new Cache instance
+// New creates a new untyped Cache instance
 func New(cfg CacheConfig) (CacheProvider, error) {
-	c := &Cache{
-		items:  make(map[string]item),
+	return NewCache[string, interface{}](cfg)
+}
+
+// NewCache creates a new Cache instance for K keys and V values
+func NewCache[K comparable, V any](cfg CacheConfig) (*Cache[K, V], error) {
+	if cfg.Shards <= 0 {
+		cfg.Shards = DefaultShards
+	}
+
+	if cfg.CleanupInterval <= 0 {
+		cfg.CleanupInterval = DefaultCacheConfig.CleanupInterval
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+
+	if cfg.MaxEntries > 0 {
+		cfg.Shards = min(cfg.Shards, cfg.MaxEntries)
+	}
+
+	c := &Cache[K, V]{
+		shards: make([]*shard[K, V], cfg.Shards),
+		seed:   maphash.MakeSeed(),
 		config: cfg,
+		done:   make(chan struct{}),
 	}
 
-	// Start cleanup goroutine
-	go c.cleanupTimer()
+	for i := range c.shards {
+		c.shards[i] = &shard[K, V]{
+			items:      make(map[K]*list.Element),
+			lru:        list.New(),
+			maxEntries: share(cfg.MaxEntries, cfg.Shards, i),
+			maxBytes:   share(cfg.MaxBytes, int64(cfg.Shards), int64(i)),
+		}
+	}
+
+	// Start cleanup goroutine, the ticker is created up front so
+	// a fake clock advanced right after New still fires it
+	go c.cleanupTimer(cfg.Clock.NewTicker(cfg.CleanupInterval))
 
 	return c, nil
 }
 
+// share returns shard i's part of limit split across n shards, the first shards take the remainder
+func share[T int | int64](limit, n, i T) T {
+	if limit <= 0 {
+		return 0
+	}
+
+	part := limit / n
+	if i < limit%n {
+		part++
+	}
+
+	return part
+}
+
+// shard returns the shard holding key
+func (c *Cache[K, V]) shard(key K) *shard[K, V] {
+	return c.shards[maphash.Comparable(c.seed, key)%uint64(len(c.shards))]
+}
+
 // Get retrieves a value from the cache by key
-func (c *Cache) Get(key string) (interface{}, bool) {
-	c.mu.RLock()
-	item, exists := c.items[key]
-	c.mu.RUnlock()
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	var zero V
+	s := c.shard(key)
 
+	s.mu.RLock()
+	el, exists := s.items[key]
 	if !exists {
-		return nil, false
+		s.mu.RUnlock()
+		return zero, false
 	}
 
+	it := el.Value.(*item[K, V])
+	value, expiration, fixed := it.value, it.expiration, it.fixed
+	it.accessed.Store(true)
+	s.mu.RUnlock()
+
 	// bail early if the item has already expired
-	if time.Now().After(item.expiration) {
-		return nil, false
+	if c.config.Clock.Now().After(expiration) {
+		return zero, false
+	}
+
+	if !c.config.Sliding || fixed {
+		return value, true
 	}
 
 	// upgrade to a write lock only when we need to bump the ttl
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	item, exists = c.items[key]
+	el, exists = s.items[key]
 	if !exists {
-		return nil, false
+		return zero, false
 	}
 
+	it = el.Value.(*item[K, V])
+
 	// item might have been updated or expired while waiting for the write lock
-	if time.Now().After(item.expiration) {
-		return nil, false
+	if c.config.Clock.Now().After(it.expiration) {
+		return zero, false
 	}
 
-	item.expiration = time.Now().Add(c.config.TTL)
-	c.items[key] = item
+	if !it.fixed {
+		it.expiration = c.config.Clock.Now().Add(it.ttl)
+	}
 
-	return item.value, true
+	return it.value, true
+}
+
+// GetStale retrieves a value from the cache by key even if it has expired,
+// as long as it is within the stale window. The expiration is returned with it.
+// It does not extend the item's TTL
+func (c *Cache[K, V]) GetStale(key K) (V, time.Time, bool) {
+	var zero V
+	s := c.shard(key)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	el, exists := s.items[key]
+	if !exists {
+		return zero, time.Time{}, false
+	}
+
+	it := el.Value.(*item[K, V])
+
+	if c.config.Clock.Now().After(it.expiration.Add(c.config.StaleWindow)) {
+		return zero, time.Time{}, false
+	}
+
+	return it.value, it.expiration, true
 }
 
 // Set stores a value in the cache with the specified key
-func (c *Cache) Set(key string, value interface{}) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.SetWithTTL(key, value, c.config.TTL)
+}
+
+// SetWithTTL stores a value in the cache with the specified key,
+// expiring after ttl instead of the configured TTL
+func (c *Cache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	c.set(key, value, ttl, false)
+}
+
+// SetFixed stores a value in the cache with the specified key,
+// expiring after ttl even when the cache is sliding
+func (c *Cache[K, V]) SetFixed(key K, value V, ttl time.Duration) {
+	c.set(key, value, ttl, true)
+}
+
+func (c *Cache[K, V]) set(key K, value V, ttl time.Duration, fixed bool) {
+	s := c.shard(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	c.items[key] = item{
+	it := &item[K, V]{
+		key:        key,
 		value:      value,
-		expiration: time.Now().Add(c.config.TTL),
+		size:       sizeOf(key, value),
+		ttl:        ttl,
+		expiration: c.config.Clock.Now().Add(ttl),
+		fixed:      fixed,
+	}
+
+	el, exists := s.items[key]
+	if exists {
+		s.bytes -= el.Value.(*item[K, V]).size
+		el.Value = it
+		s.lru.MoveToFront(el)
+	} else {
+		el = s.lru.PushFront(it)
+		s.items[key] = el
+	}
+
+	s.bytes += it.size
+	s.evict(el)
+}
+
+// Delete removes the item with the specified key
+func (c *Cache[K, V]) Delete(key K) {
+	s := c.shard(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, exists := s.items[key]; exists {
+		s.remove(el)
+	}
+}
+
+// Purge removes all items from the cache
+func (c *Cache[K, V]) Purge() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.items = make(map[K]*list.Element)
+		s.lru.Init()
+		s.bytes = 0
+		s.mu.Unlock()
+	}
+}
+
+// Len returns the number of items in the cache, including expired items not yet cleaned up
+func (c *Cache[K, V]) Len() int {
+	n := 0
+
+	for _, s := range c.shards {
+		s.mu.RLock()
+		n += len(s.items)
+		s.mu.RUnlock()
+	}
+
+	return n
+}
+
+// Range calls fn for each item in the cache, including expired items not yet cleaned up,
+// until fn returns false. Items set during Range may or may not be visited
+func (c *Cache[K, V]) Range(fn func(key K, value V, expiration time.Time) bool) {
+	for _, s := range c.shards {
+		// copy the shard so fn is free to use the cache
+		s.mu.RLock()
+		type ranged struct {
+			key        K
+			value      V
+			expiration time.Time
+		}
+
+		items := make([]ranged, 0, len(s.items))
+		for _, el := range s.items {
+			it := el.Value.(*item[K, V])
+			items = append(items, ranged{it.key, it.value, it.expiration})
+		}
+		s.mu.RUnlock()
+
+		for _, it := range items {
+			if !fn(it.key, it.value, it.expiration) {
+				return
+			}
+		}
 	}
 }
 
+// Close stops the cleanup goroutine. The cache remains usable
+func (c *Cache[K, V]) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+
+	return nil
+}
+
+// Stats returns the current cache stats
+func (c *Cache[K, V]) Stats() Stats {
+	var stats Stats
+
+	for _, s := range c.shards {
+		s.mu.RLock()
+		stats.Entries += len(s.items)
+		stats.Bytes += s.bytes
+		stats.Evictions += s.evictions
+		s.mu.RUnlock()
+	}
+
+	return stats
+}
+
+// evict removes the least recently used items until the shard is within its limits.
+// Items at the back that were used since they were set or last passed over get a second chance
+// at the front, as in CLOCK. The item just set, keep, is always kept. s.mu must be held
+func (s *shard[K, V]) evict(keep *list.Element) {
+	for s.lru.Len() > 1 &&
+		((s.maxEntries > 0 && s.lru.Len() > s.maxEntries) ||
+			(s.maxBytes > 0 && s.bytes > s.maxBytes)) {
+		el := s.lru.Back()
+
+		if el == keep || el.Value.(*item[K, V]).accessed.Swap(false) {
+			s.lru.MoveToFront(el)
+			continue
+		}
+
+		s.remove(el)
+		s.evictions++
+	}
+}
+
+// remove deletes an item from the shard. s.mu must be held
+func (s *shard[K, V]) remove(el *list.Element) {
+	it := el.Value.(*item[K, V])
+
+	s.lru.Remove(el)
+	delete(s.items, it.key)
+	s.bytes -= it.size
+}
+
+// sizeOf approximates the memory used by an item
+func sizeOf[K comparable, V any](key K, value V) int64 {
+	size := itemOverhead
+
+	if k, ok := any(key).(string); ok {
+		size += len(k)
+	}
+
+	if sizer, ok := any(value).(Sizer); ok {
+		size += sizer.Size()
+	}
+
+	return int64(size)
+}
+
 // cleanup periodically removes expired items from the cache
-func (c *Cache) cleanupTimer() {
-	ticker := time.NewTicker(c.config.CleanupInterval)
+func (c *Cache[K, V]) cleanupTimer(ticker clock.Ticker) {
 	defer ticker.Stop()
 
-	for range ticker.C {
-		c.Cleanup()
+	for {
+		select {
+		case <-ticker.C():
+			c.Cleanup()
+		case <-c.done:
+			return
+		}
 	}
 }
 
-// Cleanup removes expired items from the cache
-func (c *Cache) Cleanup() {
+// Cleanup removes items from the cache that have expired past the stale window
+// and reports evictions since the last cleanup
+func (c *Cache[K, V]) Cleanup() {
 	deleted := 0
+	entries := 0
+	var evicted uint64
 
-	c.mu.Lock()
-	for key, item := range c.items {
-		if time.Now().After(item.expiration) {
-			delete(c.items, key)
-			deleted++
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for _, el := range s.items {
+			if c.config.Clock.Now().After(el.Value.(*item[K, V]).expiration.Add(c.config.StaleWindow)) {
+				s.remove(el)
+				deleted++
+			}
 		}
+
+		evicted += s.evictions - s.reported
+		s.reported = s.evictions
+		entries += len(s.items)
+		s.mu.Unlock()
 	}
-	c.mu.Unlock()
 
-	if deleted > 0 {
-		c.config.Logger.Info("cache cleanup", "deleted", deleted)
+	if deleted > 0 || evicted > 0 {
+		c.config.Logger.Info("cache cleanup", "deleted", deleted, "evicted", evicted, "entries", entries)
 	}
 }
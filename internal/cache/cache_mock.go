@@ -1,5 +1,7 @@
 package cache
 
+import "time"
+
 type MockCache struct {
 	items map[string]interface{}
 }
@@ -12,13 +14,55 @@ func Mock() CacheProvider {
 }
 
 func (c *MockCache) Get(key string) (interface{}, bool) {
-	return c.items[key], true
+	value, ok := c.items[key]
+	return value, ok
+}
+
+func (c *MockCache) GetStale(key string) (interface{}, time.Time, bool) {
+	value, ok := c.items[key]
+	return value, time.Time{}, ok
 }
 
 func (c *MockCache) Set(key string, value interface{}) {
 	c.items[key] = value
 }
 
+func (c *MockCache) SetWithTTL(key string, value interface{}, ttl time.Duration) {
+	c.items[key] = value
+}
+
+func (c *MockCache) SetFixed(key string, value interface{}, ttl time.Duration) {
+	c.items[key] = value
+}
+
+func (c *MockCache) Delete(key string) {
+	delete(c.items, key)
+}
+
+func (c *MockCache) Purge() {
+	c.items = make(map[string]interface{})
+}
+
+func (c *MockCache) Len() int {
+	return len(c.items)
+}
+
+func (c *MockCache) Range(fn func(key string, value interface{}, expiration time.Time) bool) {
+	for key, value := range c.items {
+		if !fn(key, value, time.Time{}) {
+			return
+		}
+	}
+}
+
 func (c *MockCache) Cleanup() {
 	c.items = make(map[string]interface{})
 }
+
+func (c *MockCache) Stats() Stats {
+	return Stats{Entries: len(c.items)}
+}
+
+func (c *MockCache) Close() error {
+	return nil
+}
@@ -1,8 +1,11 @@
 package cache
 
 import (
+	"fmt"
 	"testing"
 	"time"
+
+	"github.com/twopow/srd/internal/clock"
 )
 
 func TestCache_SetAndGet(t *testing.T) {
@@ -15,6 +18,7 @@ func TestCache_SetAndGet(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer cache.Close()
 
 	tests := []struct {
 		name     string
@@ -62,7 +66,9 @@ func TestCache_SetAndGet(t *testing.T) {
 }
 
 func TestCache_GetExpiredCleanup(t *testing.T) {
+	clk := clock.NewFake(time.Now())
 	cfg := CacheConfig{
+		Clock:           clk,
 		TTL:             time.Millisecond * 100, // Very short TTL for testing
 		CleanupInterval: time.Second * 10,
 	}
@@ -71,12 +77,13 @@ func TestCache_GetExpiredCleanup(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer cache.Close()
 
 	// Set a value
 	cache.Set("test-key", "test-value")
 
 	// Wait for the TTL to expire
-	time.Sleep(time.Millisecond * 150)
+	clk.Advance(time.Millisecond * 150)
 
 	// Try to get the expired value
 	_, found := cache.Get("test-key")
@@ -95,9 +102,579 @@ func TestCache_GetNonExistent(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer cache.Close()
 
 	_, found := cache.Get("non-existent-key")
 	if found {
 		t.Error("Cache.Get() found non-existent value, want not found")
 	}
 }
+
+func TestCache_SetWithTTL(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	cfg := CacheConfig{
+		Clock:           clk,
+		TTL:             time.Second * 5,
+		CleanupInterval: time.Second * 10,
+	}
+
+	cache, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.SetWithTTL("short", "value", time.Millisecond*100)
+	cache.Set("default", "value")
+
+	clk.Advance(time.Millisecond * 150)
+
+	if _, found := cache.Get("short"); found {
+		t.Error("Cache.Get() found value past its own ttl, want not found")
+	}
+
+	if _, found := cache.Get("default"); !found {
+		t.Error("Cache.Get() did not find value within the default ttl")
+	}
+}
+
+func TestCache_GetStale(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	cfg := CacheConfig{
+		Clock:           clk,
+		TTL:             time.Millisecond * 100,
+		CleanupInterval: time.Second * 10,
+		StaleWindow:     time.Millisecond * 200,
+	}
+
+	cache, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Set("test-key", "test-value")
+
+	clk.Advance(time.Millisecond * 150)
+
+	if _, found := cache.Get("test-key"); found {
+		t.Error("Cache.Get() found expired value, want not found")
+	}
+
+	got, expiration, found := cache.GetStale("test-key")
+	if !found || got != "test-value" {
+		t.Errorf("Cache.GetStale() = %v, %v, want stale value", got, found)
+	}
+
+	if !clk.Now().After(expiration) {
+		t.Errorf("Cache.GetStale() expiration = %v, want in the past", expiration)
+	}
+
+	// cleanup keeps items within the stale window
+	cache.Cleanup()
+	if _, _, found := cache.GetStale("test-key"); !found {
+		t.Error("Cache.Cleanup() removed item within the stale window")
+	}
+
+	clk.Advance(time.Millisecond * 200)
+
+	if _, _, found := cache.GetStale("test-key"); found {
+		t.Error("Cache.GetStale() found value past the stale window, want not found")
+	}
+}
+
+func TestCache_AbsoluteExpiry(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	cfg := CacheConfig{
+		Clock:           clk,
+		TTL:             time.Millisecond * 100,
+		CleanupInterval: time.Second * 10,
+	}
+
+	cache, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Set("test-key", "test-value")
+
+	// reads do not extend the expiry
+	for i := 0; i < 3; i++ {
+		clk.Advance(time.Millisecond * 40)
+		cache.Get("test-key")
+	}
+
+	if _, found := cache.Get("test-key"); found {
+		t.Error("Cache.Get() found value past its ttl despite reads, want not found")
+	}
+}
+
+func TestCache_SlidingExpiry(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	cfg := CacheConfig{
+		Clock:           clk,
+		TTL:             time.Millisecond * 100,
+		CleanupInterval: time.Second * 10,
+		Sliding:         true,
+	}
+
+	cache, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Set("test-key", "test-value")
+
+	// each read pushes the expiry forward
+	for i := 0; i < 3; i++ {
+		clk.Advance(time.Millisecond * 60)
+		if _, found := cache.Get("test-key"); !found {
+			t.Fatal("Cache.Get() did not find value kept alive by reads")
+		}
+	}
+}
+
+func TestCache_SetFixed(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	cfg := CacheConfig{
+		Clock:           clk,
+		TTL:             time.Millisecond * 100,
+		CleanupInterval: time.Second * 10,
+		Sliding:         true,
+	}
+
+	cache, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.SetFixed("test-key", "test-value", time.Millisecond*100)
+
+	// reads do not push the expiry of a fixed item forward
+	for i := 0; i < 3; i++ {
+		clk.Advance(time.Millisecond * 30)
+		cache.Get("test-key")
+	}
+
+	clk.Advance(time.Millisecond * 30)
+
+	if _, found := cache.Get("test-key"); found {
+		t.Error("Cache.Get() found fixed value past its ttl despite sliding, want not found")
+	}
+}
+
+func TestCache_CleanupTicker(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	cfg := CacheConfig{
+		Clock:           clk,
+		TTL:             time.Second * 5,
+		CleanupInterval: time.Second * 10,
+	}
+
+	cache, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Set("test-key", "test-value")
+
+	clk.Advance(time.Second * 10)
+
+	// the cleanup goroutine runs on its own, wait for it to catch up
+	deadline := time.Now().Add(time.Second)
+	for cache.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if cache.Len() != 0 {
+		t.Errorf("Cache.Len() = %d after cleanup tick, want 0", cache.Len())
+	}
+}
+
+type sizedValue string
+
+func (v sizedValue) Size() int {
+	return len(v)
+}
+
+func TestCache_MaxEntries(t *testing.T) {
+	cfg := CacheConfig{
+		TTL:             time.Second * 5,
+		CleanupInterval: time.Second * 10,
+		MaxEntries:      2,
+		Shards:          1,
+	}
+
+	cache, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Set("a", 1)
+	cache.Set("b", 2)
+
+	// touch a so b becomes the least recently used
+	cache.Get("a")
+	cache.Set("c", 3)
+
+	if _, found := cache.Get("b"); found {
+		t.Error("Cache.Get() found least recently used item, want evicted")
+	}
+
+	for _, key := range []string{"a", "c"} {
+		if _, found := cache.Get(key); !found {
+			t.Errorf("Cache.Get(%q) not found, want kept", key)
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.Entries != 2 || stats.Evictions != 1 {
+		t.Errorf("Cache.Stats() = %+v, want 2 entries and 1 eviction", stats)
+	}
+}
+
+func TestCache_MaxBytes(t *testing.T) {
+	cfg := CacheConfig{
+		TTL:             time.Second * 5,
+		CleanupInterval: time.Second * 10,
+		MaxBytes:        2 * (itemOverhead + 1 + 100),
+		Shards:          1,
+	}
+
+	cache, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	value := sizedValue(make([]byte, 100))
+
+	cache.Set("a", value)
+	cache.Set("b", value)
+
+	if stats := cache.Stats(); stats.Evictions != 0 || stats.Bytes != cfg.MaxBytes {
+		t.Fatalf("Cache.Stats() = %+v, want no evictions at the byte budget", stats)
+	}
+
+	cache.Set("c", value)
+
+	if _, found := cache.Get("a"); found {
+		t.Error("Cache.Get() found least recently used item, want evicted over the byte budget")
+	}
+
+	// replacing an item accounts for its new size only
+	cache.Set("c", sizedValue(""))
+	if stats := cache.Stats(); stats.Bytes != 2*itemOverhead+2+100 {
+		t.Errorf("Cache.Stats() bytes = %d, want %d", stats.Bytes, 2*itemOverhead+2+100)
+	}
+}
+
+func TestCache_Typed(t *testing.T) {
+	type record struct {
+		To   string
+		Code int
+	}
+
+	cache, err := NewCache[string, record](CacheConfig{
+		TTL:             time.Second * 5,
+		CleanupInterval: time.Second * 10,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Set("example.com", record{To: "https://example.net", Code: 301})
+
+	got, found := cache.Get("example.com")
+	if !found || got.To != "https://example.net" || got.Code != 301 {
+		t.Errorf("Cache.Get() = %v, %v, want stored record", got, found)
+	}
+
+	got, found = cache.Get("missing.com")
+	if found || got != (record{}) {
+		t.Errorf("Cache.Get() = %v, %v, want zero value and not found", got, found)
+	}
+}
+
+func TestCache_ShardedMaxEntries(t *testing.T) {
+	cfg := CacheConfig{
+		TTL:             time.Second * 5,
+		CleanupInterval: time.Second * 10,
+		MaxEntries:      64,
+		Shards:          4,
+	}
+
+	cache, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	for i := 0; i < 1000; i++ {
+		cache.Set(fmt.Sprintf("host-%d", i), i)
+	}
+
+	stats := cache.Stats()
+	if stats.Entries > cfg.MaxEntries {
+		t.Errorf("Cache.Stats() entries = %d, want at most %d", stats.Entries, cfg.MaxEntries)
+	}
+
+	if stats.Evictions != uint64(1000-stats.Entries) {
+		t.Errorf("Cache.Stats() evictions = %d, want %d", stats.Evictions, 1000-stats.Entries)
+	}
+
+	// the most recently set item is always kept
+	if _, found := cache.Get("host-999"); !found {
+		t.Error("Cache.Get() did not find most recently set item")
+	}
+}
+
+func TestCache_MaxEntriesAcrossShards(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxEntries int
+		shards     int
+	}{
+		{name: "fewer entries than shards", maxEntries: 3, shards: DefaultShards},
+		{name: "uneven split", maxEntries: 20, shards: DefaultShards},
+		{name: "even split", maxEntries: 64, shards: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, err := New(CacheConfig{
+				TTL:             time.Second * 5,
+				CleanupInterval: time.Second * 10,
+				MaxEntries:      tt.maxEntries,
+				Shards:          tt.shards,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cache.Close()
+
+			for i := 0; i < 1000; i++ {
+				cache.Set(fmt.Sprintf("host-%d", i), i)
+			}
+
+			if n := cache.Len(); n > tt.maxEntries {
+				t.Errorf("Cache.Len() = %d, want at most %d", n, tt.maxEntries)
+			}
+		})
+	}
+}
+
+func TestCache_Delete(t *testing.T) {
+	cache, err := New(CacheConfig{TTL: time.Minute, CleanupInterval: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Set("a", sizedValue("0123456789"))
+	cache.Set("b", sizedValue("0123456789"))
+	cache.Delete("a")
+	cache.Delete("missing")
+
+	if _, found := cache.Get("a"); found {
+		t.Error("Cache.Get() found deleted key")
+	}
+
+	if _, found := cache.Get("b"); !found {
+		t.Error("Cache.Get() did not find key b")
+	}
+
+	if cache.Len() != 1 {
+		t.Errorf("Cache.Len() = %d, want 1", cache.Len())
+	}
+
+	if stats := cache.Stats(); stats.Bytes != int64(itemOverhead+1+10) {
+		t.Errorf("Cache.Stats() bytes = %d, want %d", stats.Bytes, itemOverhead+1+10)
+	}
+}
+
+func TestCache_Purge(t *testing.T) {
+	cache, err := New(CacheConfig{TTL: time.Minute, CleanupInterval: time.Minute, MaxEntries: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	for i := 0; i < 10; i++ {
+		cache.Set(fmt.Sprintf("key-%d", i), i)
+	}
+
+	cache.Purge()
+
+	if cache.Len() != 0 {
+		t.Errorf("Cache.Len() = %d, want 0", cache.Len())
+	}
+
+	if stats := cache.Stats(); stats.Bytes != 0 {
+		t.Errorf("Cache.Stats() bytes = %d, want 0", stats.Bytes)
+	}
+
+	// the cache is still usable after a purge
+	cache.Set("key-0", 0)
+	if _, found := cache.Get("key-0"); !found {
+		t.Error("Cache.Get() did not find key set after purge")
+	}
+}
+
+func TestCache_Range(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	cache, err := NewCache[string, int](CacheConfig{Clock: clk, TTL: time.Minute, CleanupInterval: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	for i := 0; i < 10; i++ {
+		cache.SetWithTTL(fmt.Sprintf("key-%d", i), i, time.Second*time.Duration(i))
+	}
+
+	seen := map[string]time.Time{}
+	cache.Range(func(key string, value int, expiration time.Time) bool {
+		seen[key] = expiration
+		return true
+	})
+
+	if len(seen) != 10 {
+		t.Fatalf("Cache.Range() visited %d items, want 10", len(seen))
+	}
+
+	if want := clk.Now().Add(time.Second * 3); !seen["key-3"].Equal(want) {
+		t.Errorf("Cache.Range() expiration = %v, want %v", seen["key-3"], want)
+	}
+
+	visited := 0
+	cache.Range(func(key string, value int, expiration time.Time) bool {
+		visited++
+		return visited < 3
+	})
+
+	if visited != 3 {
+		t.Errorf("Cache.Range() visited %d items after stopping, want 3", visited)
+	}
+}
+
+func TestCache_Close(t *testing.T) {
+	cache, err := NewCache[string, int](CacheConfig{TTL: time.Minute, CleanupInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// the cleanup goroutine must not block a second close
+		cache.Close()
+		cache.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Cache.Close() did not return")
+	}
+
+	cache.Set("a", 1)
+	if v, found := cache.Get("a"); !found || v != 1 {
+		t.Errorf("Cache.Get() = %v, %v after close, want 1, true", v, found)
+	}
+}
+
+func TestCache_DefaultCleanupInterval(t *testing.T) {
+	// a zero interval used to panic in the cleanup goroutine
+	cache, err := New(CacheConfig{TTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	cache.Set("a", 1)
+	if _, found := cache.Get("a"); !found {
+		t.Error("Cache.Get() did not find key a")
+	}
+}
+
+func TestMockCache_GetMiss(t *testing.T) {
+	cache := Mock()
+
+	if _, found := cache.Get("missing"); found {
+		t.Error("MockCache.Get() found missing key")
+	}
+
+	cache.Set("a", 1)
+	if v, found := cache.Get("a"); !found || v != 1 {
+		t.Errorf("MockCache.Get() = %v, %v, want 1, true", v, found)
+	}
+
+	cache.Delete("a")
+	if cache.Len() != 0 {
+		t.Errorf("MockCache.Len() = %d, want 0", cache.Len())
+	}
+}
+
+//
+// Benchmarks
+//
+
+func benchmarkParallel(b *testing.B, cfg CacheConfig, writeEvery int) {
+	cache, err := NewCache[string, int](cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cache.Close()
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("host-%d.example.com", i)
+		cache.Set(keys[i], i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if writeEvery > 0 && i%writeEvery == 0 {
+				cache.Set(key, i)
+			} else {
+				cache.Get(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkCache_ParallelGet(b *testing.B) {
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			benchmarkParallel(b, CacheConfig{TTL: time.Minute, CleanupInterval: time.Minute, Shards: shards}, 0)
+		})
+	}
+}
+
+func BenchmarkCache_ParallelGetSet(b *testing.B) {
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			benchmarkParallel(b, CacheConfig{TTL: time.Minute, CleanupInterval: time.Minute, Shards: shards}, 10)
+		})
+	}
+}
+
+func BenchmarkCache_ParallelGetSetBounded(b *testing.B) {
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			benchmarkParallel(b, CacheConfig{TTL: time.Minute, CleanupInterval: time.Minute, Shards: shards, MaxEntries: 512}, 10)
+		})
+	}
+}
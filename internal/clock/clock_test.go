@@ -0,0 +1,113 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake_Advance(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFake(start)
+
+	c.Advance(time.Minute)
+
+	if got := c.Now(); !got.Equal(start.Add(time.Minute)) {
+		t.Errorf("Now() = %s, want %s", got, start.Add(time.Minute))
+	}
+
+	if got := c.Since(start); got != time.Minute {
+		t.Errorf("Since() = %s, want 1m", got)
+	}
+
+	if got := c.Until(start.Add(time.Hour)); got != time.Minute*59 {
+		t.Errorf("Until() = %s, want 59m", got)
+	}
+}
+
+func TestFake_Ticker(t *testing.T) {
+	c := NewFake(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	ticker := c.NewTicker(time.Second * 10)
+
+	c.Advance(time.Second * 9)
+	select {
+	case <-ticker.C():
+		t.Fatal("ticker fired before its period")
+	default:
+	}
+
+	c.Advance(time.Second)
+	select {
+	case <-ticker.C():
+	default:
+		t.Fatal("ticker did not fire after its period")
+	}
+
+	// ticks are dropped while the previous one is unread
+	c.Advance(time.Second * 30)
+	c.Advance(time.Second * 10)
+	<-ticker.C()
+	select {
+	case <-ticker.C():
+		t.Fatal("ticker delivered a dropped tick")
+	default:
+	}
+
+	ticker.Stop()
+	c.Advance(time.Minute)
+	select {
+	case <-ticker.C():
+		t.Fatal("stopped ticker fired")
+	default:
+	}
+}
+
+func TestFake_Timer(t *testing.T) {
+	c := NewFake(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	timer := c.NewTimer(time.Second * 10)
+
+	c.Advance(time.Second * 9)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired before its duration")
+	default:
+	}
+
+	c.Advance(time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Fatal("timer did not fire after its duration")
+	}
+
+	// a timer fires only once
+	c.Advance(time.Minute)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired twice")
+	default:
+	}
+
+	if timer.Reset(time.Second) {
+		t.Error("Reset() = true for a fired timer, want false")
+	}
+
+	// a tick that was not received is dropped by Reset
+	c.Advance(time.Second)
+	timer.Reset(time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("timer delivered a tick from before Reset")
+	default:
+	}
+
+	if !timer.Stop() {
+		t.Error("Stop() = false for a pending timer, want true")
+	}
+
+	c.Advance(time.Minute)
+	select {
+	case <-timer.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+}
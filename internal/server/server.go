@@ -1,10 +1,13 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/twopow/srd/handlers"
 	"github.com/twopow/srd/resolver"
@@ -14,6 +17,10 @@ type ServerConfig struct {
 	Host        string            `help:"Host for the HTTP server." default:"localhost"`
 	Port        int               `help:"Port for the HTTP server." default:"8080"`
 	CaddyHelper CaddyHelperConfig `help:"Caddy helper server configuration." embed:"" prefix:"caddyhelper."`
+	Peer        PeerConfig        `help:"Peer server configuration." embed:"" prefix:"peer."`
+	Admin       AdminConfig       `help:"Admin server configuration." embed:"" prefix:"admin."`
+
+	ShutdownTimeout time.Duration `help:"How long in-flight requests get to finish on shutdown." default:"10s"`
 }
 
 type CaddyHelperConfig struct {
@@ -22,50 +29,105 @@ type CaddyHelperConfig struct {
 	Port    int    `help:"Port for the Caddy helper server." default:"8081"`
 }
 
+type PeerConfig struct {
+	Enabled bool   `help:"Enable the peer server other SRD replicas share records through. Must not be publicly reachable." default:"false"`
+	Host    string `help:"Host for the peer server." default:"localhost"`
+	Port    int    `help:"Port for the peer server." default:"8082"`
+}
+
+type AdminConfig struct {
+	Enabled bool   `help:"Enable the admin server operators invalidate cached records through. Must not be publicly reachable." default:"false"`
+	Host    string `help:"Host for the admin server." default:"localhost"`
+	Port    int    `help:"Port for the admin server." default:"8083"`
+}
+
 var log *slog.Logger
 
-func Start(cfg ServerConfig, rp resolver.ResolverProvider, logger *slog.Logger) error {
+// Start starts the servers and blocks until ctx is done, then shuts them down
+// so in-flight requests finish before the caller closes the resolver
+func Start(ctx context.Context, cfg ServerConfig, rp resolver.ResolverProvider, logger *slog.Logger) error {
 	log = logger
 
-	// Start both servers concurrently
-	go func() {
-		if err := startServer(cfg, rp); err != nil {
-			log.Error("failed to start main server", "error", err)
-			os.Exit(1)
-		}
-	}()
+	servers := map[string]*http.Server{
+		"main server": newServer(cfg, rp),
+	}
 
 	if cfg.CaddyHelper.Enabled {
+		servers["caddy helper server"] = newCaddyHelper(cfg.CaddyHelper, rp)
+	}
+
+	if cfg.Peer.Enabled {
+		servers["peer server"] = newPeer(cfg.Peer, rp)
+	}
+
+	if cfg.Admin.Enabled {
+		servers["admin server"] = newAdmin(cfg.Admin, rp)
+	}
+
+	// Start the servers concurrently
+	for name, srv := range servers {
 		go func() {
-			if err := startCaddyHelper(cfg.CaddyHelper, rp); err != nil {
-				log.Error("failed to start caddy helper server", "error", err)
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error("failed to start "+name, "error", err)
 				os.Exit(1)
 			}
 		}()
 	}
 
-	// Keep the main goroutine alive
-	select {}
+	// Keep the main goroutine alive until shutdown
+	<-ctx.Done()
+	log.Info("shutting down", "timeout", cfg.ShutdownTimeout.Seconds())
+
+	sctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	var errs []error
+	for name, srv := range servers {
+		if err := srv.Shutdown(sctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to shut down %s: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
-// StartServer starts an HTTP server on the specified host and port
-func startServer(cfg ServerConfig, rp resolver.ResolverProvider) error {
+// newServer returns the HTTP server for the specified host and port
+func newServer(cfg ServerConfig, rp resolver.ResolverProvider) *http.Server {
 	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
 	log.Info("booting server", "addr", addr)
 
 	http.HandleFunc("/", handlers.ResolveHandler(rp))
 
-	return http.ListenAndServe(addr, nil)
+	return &http.Server{Addr: addr}
 }
 
-// StartCaddyHelper starts a Caddy helper server on the specified host and port
+// newCaddyHelper returns a Caddy helper server for the specified host and port
 // CadddyHelper is used to check if a cert should be issued for a given hostname
 // ref: https://caddyserver.com/docs/caddyfile/options#on-demand-tls
-func startCaddyHelper(cfg CaddyHelperConfig, rp resolver.ResolverProvider) error {
+func newCaddyHelper(cfg CaddyHelperConfig, rp resolver.ResolverProvider) *http.Server {
 	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
 	log.Info("booting caddy helper", "addr", addr)
 
 	http.HandleFunc("/ask", handlers.CaddyHelperHandler(rp))
 
-	return http.ListenAndServe(addr, nil)
+	return &http.Server{Addr: addr}
+}
+
+// newPeer returns the peer server for the specified host and port
+func newPeer(cfg PeerConfig, rp resolver.ResolverProvider) *http.Server {
+	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	log.Info("booting peer server", "addr", addr)
+
+	return &http.Server{Addr: addr, Handler: rp.PeerHandler()}
+}
+
+// newAdmin returns the admin server for the specified host and port
+func newAdmin(cfg AdminConfig, rp resolver.ResolverProvider) *http.Server {
+	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	log.Info("booting admin server", "addr", addr)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /invalidate", handlers.InvalidateHandler(rp))
+
+	return &http.Server{Addr: addr, Handler: mux}
 }
@@ -3,13 +3,12 @@ package util
 import (
 	"fmt"
 	"log/slog"
-	"regexp"
+	"net/netip"
+	"strings"
 
 	"github.com/google/uuid"
 )
 
-var IpRegex = regexp.MustCompile(`^(?:[0-9]{1,3}\.){3}[0-9]{1,3}(?::[0-9]{1,5})?$`)
-
 func UUID7() uuid.UUID {
 	u, err := uuid.NewV7()
 	if err != nil {
@@ -20,6 +19,43 @@ func UUID7() uuid.UUID {
 	return u
 }
 
+// IsIp reports whether hostname is an IPv4 or IPv6 address, with or without a port.
+// IPv6 addresses with a port are bracketed, e.g. [::1]:8080
 func IsIp(hostname string) bool {
-	return IpRegex.MatchString(hostname)
+	host := StripPort(hostname)
+	if strings.HasPrefix(host, "[") {
+		if !strings.HasSuffix(host, "]") {
+			return false
+		}
+
+		host = host[1 : len(host)-1]
+	}
+
+	_, err := netip.ParseAddr(host)
+	return err == nil
+}
+
+// StripPort removes the port from a host as found in the Host header, e.g. example.com:8080.
+// Bracketed IPv6 addresses keep their brackets, bare IPv6 addresses are returned as they are
+func StripPort(host string) string {
+	if strings.HasPrefix(host, "[") {
+		if end := strings.IndexByte(host, ']'); end > 0 {
+			return host[:end+1]
+		}
+
+		return host
+	}
+
+	// more than one colon is a bare IPv6 address
+	i := strings.IndexByte(host, ':')
+	if i < 0 || strings.Count(host, ":") > 1 {
+		return host
+	}
+
+	port := host[i+1:]
+	if port == "" || strings.Trim(port, "0123456789") != "" {
+		return host
+	}
+
+	return host[:i]
 }
@@ -115,34 +115,72 @@ func TestIsIp(t *testing.T) {
 			expected: false,
 		},
 
-		// Note: The current regex allows these cases, so they're expected to pass
-		// These are technically invalid but match the regex pattern
+		// Invalid addresses
 		{
-			name:     "IPv4 with octet > 255 (regex allows this)",
+			name:     "IPv4 with octet > 255",
 			hostname: "256.1.1.1",
-			expected: true,
+			expected: false,
 		},
 		{
-			name:     "IPv4 with leading zeros (regex allows this)",
+			name:     "IPv4 with leading zeros",
 			hostname: "192.168.01.1",
-			expected: true,
+			expected: false,
 		},
+
+		// Ports are not validated, the host is still an IP
 		{
-			name:     "IPv4 with port > 65535 (regex allows this)",
+			name:     "IPv4 with port > 65535",
 			hostname: "192.168.1.1:65536",
 			expected: true,
 		},
 		{
-			name:     "IPv4 with port 0 (regex allows this)",
+			name:     "IPv4 with port 0",
 			hostname: "192.168.1.1:0",
 			expected: true,
 		},
 		{
-			name:     "IPv4 with port with leading zeros (regex allows this)",
+			name:     "IPv4 with port with leading zeros",
 			hostname: "192.168.1.1:080",
 			expected: true,
 		},
 
+		// IPv6 addresses
+		{
+			name:     "IPv6 address",
+			hostname: "2001:db8::1",
+			expected: true,
+		},
+		{
+			name:     "IPv6 loopback",
+			hostname: "::1",
+			expected: true,
+		},
+		{
+			name:     "bracketed IPv6",
+			hostname: "[::1]",
+			expected: true,
+		},
+		{
+			name:     "bracketed IPv6 with port",
+			hostname: "[2001:db8::1]:8080",
+			expected: true,
+		},
+		{
+			name:     "IPv4-mapped IPv6",
+			hostname: "::ffff:192.168.1.1",
+			expected: true,
+		},
+		{
+			name:     "unterminated bracket",
+			hostname: "[::1",
+			expected: false,
+		},
+		{
+			name:     "invalid IPv6",
+			hostname: "2001:db8::g",
+			expected: false,
+		},
+
 		// Non-IP strings
 		{
 			name:     "domain name",
@@ -169,11 +207,6 @@ func TestIsIp(t *testing.T) {
 			hostname: ":",
 			expected: false,
 		},
-		{
-			name:     "IPv6 address",
-			hostname: "2001:db8::1",
-			expected: false,
-		},
 		{
 			name:     "random string",
 			hostname: "not an ip",
@@ -200,3 +233,28 @@ func TestIsIp(t *testing.T) {
 		})
 	}
 }
+
+func TestStripPort(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{host: "example.com", expected: "example.com"},
+		{host: "example.com:8080", expected: "example.com"},
+		{host: "example.com:", expected: "example.com:"},
+		{host: "example.com:abc", expected: "example.com:abc"},
+		{host: "127.0.0.1:80", expected: "127.0.0.1"},
+		{host: "[::1]:8080", expected: "[::1]"},
+		{host: "[::1]", expected: "[::1]"},
+		{host: "::1", expected: "::1"},
+		{host: "", expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := StripPort(tt.host); got != tt.expected {
+				t.Errorf("StripPort(%q) = %q, expected %q", tt.host, got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,719 @@
+package resolver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/twopow/srd/internal/clock"
+)
+
+const (
+	// dnsPort is the default port for upstream servers
+	dnsPort = "53"
+
+	// udpPayloadSize is the EDNS0 payload size we advertise, see https://www.dnsflagday.net/2020/
+	udpPayloadSize = 1232
+
+	// ednsExtendedError is the EDNS0 option code for extended DNS errors, RFC 8914
+	ednsExtendedError = 15
+)
+
+// bogusErrors are the extended DNS error codes for answers that failed DNSSEC validation, RFC 8914 section 4
+var bogusErrors = map[uint16]string{
+	6:  "DNSSEC bogus",
+	7:  "signature expired",
+	8:  "signature not yet valid",
+	9:  "DNSKEY missing",
+	10: "RRSIGs missing",
+	11: "no zone key bit set",
+	12: "NSEC missing",
+}
+
+type DNSClientConfig struct {
+	// Servers is the list of upstream DNS servers, e.g. "10.0.0.53" or "10.0.0.53:5353",
+	// DNS over TLS servers, e.g. "tls://dns.example" or "tls://10.0.0.53:853#dns.example"
+	// to connect to an address and authenticate a name, or DNS over HTTPS endpoints,
+	// e.g. "https://dns.example/dns-query". servers are tried in order
+	Servers []string
+
+	// Timeout is the per-query timeout
+	Timeout time.Duration
+
+	// Retries is how many more times the server list is tried after the first pass
+	Retries int
+
+	// TrustAD reports answers with the AD bit set as secure and server failures explained
+	// by a DNSSEC extended error (RFC 8914) as bogus. Only set it when the servers are
+	// validating resolvers reached over a trusted path, e.g. on the same host, RFC 6840 section 5.7
+	TrustAD bool
+
+	// DoHMethod is the HTTP method used for DNS over HTTPS queries, GET or POST
+	DoHMethod string
+
+	// Bootstrap is the list of plain DNS servers used to resolve the hostnames of
+	// DNS over TLS servers and DNS over HTTPS endpoints, the system resolver is used when empty
+	Bootstrap []string
+
+	// TLSConfig is used for DNS over TLS and DNS over HTTPS connections, nil for the system roots
+	TLSConfig *tls.Config
+
+	// SPKIPins are base64 SHA-256 hashes of the public keys DNS over TLS servers may present.
+	// When set, a server is authenticated by its key alone, RFC 7858 section 4.2: the key of its
+	// certificate, or of a certificate further up its chain once the chain is verified up to it
+	SPKIPins []string
+
+	// IdleTimeout is how long DNS over TLS and DNS over HTTPS connections are kept open without queries
+	IdleTimeout time.Duration
+
+	// HedgeDelay is how long a query waits for a server's answer before it is also sent
+	// to the next server, 0 to only move on once the server failed
+	HedgeDelay time.Duration
+
+	// CircuitThreshold is how many consecutive failures open a server's circuit, negative to never open it.
+	// Servers with an open circuit are tried after the others, except for a probe every CircuitCooldown
+	CircuitThreshold int
+	CircuitCooldown  time.Duration
+
+	// Clock times queries, hedging and circuits, defaults to clock.Real
+	Clock clock.Clock
+
+	// Logger reports changes in the servers' health and bogus answers, defaults to slog.Default()
+	Logger *slog.Logger
+}
+
+var DefaultDNSClientConfig = DNSClientConfig{
+	Timeout:     time.Millisecond * 500,
+	Retries:     1,
+	DoHMethod:   http.MethodGet,
+	IdleTimeout: time.Second * 30,
+
+	CircuitThreshold: 5,
+	CircuitCooldown:  time.Second * 30,
+}
+
+// DNSClient is a small stub resolver that queries the configured
+// upstream servers over UDP, falling back to TCP on truncation,
+// over TLS, RFC 7858, or over HTTPS, RFC 8484
+type DNSClient struct {
+	upstreams []upstream
+	cfg       DNSClientConfig
+
+	// health tracks the upstreams, by index
+	health []*upstreamHealth
+
+	// dialer connects to DNS over TLS servers and DNS over HTTPS endpoints
+	dialer *net.Dialer
+
+	// http is shared by the DNS over HTTPS endpoints so their connections are reused
+	http *http.Client
+
+	// pins are the decoded SPKIPins
+	pins [][]byte
+}
+
+// upstream is a server the client sends queries to
+type upstream interface {
+	// exchange sends a single query for question and returns the response
+	exchange(ctx context.Context, question dnsmessage.Question) (*dnsmessage.Message, error)
+
+	// String returns the server as it appears in errors
+	String() string
+
+	// Close closes the connections kept open to the server
+	Close() error
+}
+
+var errTruncated = errors.New("response truncated")
+
+// NewDNSClient creates a new DNSClient instance
+func NewDNSClient(cfg DNSClientConfig) (*DNSClient, error) {
+	if len(cfg.Servers) == 0 {
+		return nil, fmt.Errorf("at least one dns server is required")
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultDNSClientConfig.Timeout
+	}
+
+	if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+
+	if cfg.DoHMethod == "" {
+		cfg.DoHMethod = DefaultDNSClientConfig.DoHMethod
+	}
+
+	cfg.DoHMethod = strings.ToUpper(cfg.DoHMethod)
+	if cfg.DoHMethod != http.MethodGet && cfg.DoHMethod != http.MethodPost {
+		return nil, fmt.Errorf("invalid dns over https method %q, allowed values are GET and POST", cfg.DoHMethod)
+	}
+
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DefaultDNSClientConfig.IdleTimeout
+	}
+
+	if cfg.CircuitThreshold == 0 {
+		cfg.CircuitThreshold = DefaultDNSClientConfig.CircuitThreshold
+	}
+
+	if cfg.CircuitCooldown <= 0 {
+		cfg.CircuitCooldown = DefaultDNSClientConfig.CircuitCooldown
+	}
+
+	if cfg.HedgeDelay < 0 {
+		cfg.HedgeDelay = 0
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real
+	}
+
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+
+	c := &DNSClient{cfg: cfg, dialer: &net.Dialer{}}
+
+	if len(cfg.Bootstrap) > 0 {
+		resolver, err := bootstrapResolver(cfg.Bootstrap)
+		if err != nil {
+			return nil, err
+		}
+
+		c.dialer.Resolver = resolver
+	}
+
+	for _, pin := range cfg.SPKIPins {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(pin))
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid spki pin %q, want a base64 sha-256 hash", pin)
+		}
+
+		c.pins = append(c.pins, sum)
+	}
+
+	for _, server := range cfg.Servers {
+		u, err := c.newUpstream(server)
+		if err != nil {
+			return nil, err
+		}
+
+		c.upstreams = append(c.upstreams, u)
+		c.health = append(c.health, &upstreamHealth{
+			server:    u.String(),
+			threshold: cfg.CircuitThreshold,
+			cooldown:  cfg.CircuitCooldown,
+			clock:     cfg.Clock,
+			logger:    cfg.Logger,
+		})
+	}
+
+	return c, nil
+}
+
+// newUpstream returns the upstream for a server from the config
+func (c *DNSClient) newUpstream(server string) (upstream, error) {
+	scheme, _, ok := strings.Cut(strings.TrimSpace(server), "://")
+
+	switch {
+	case !ok:
+	case strings.EqualFold(scheme, "tls"):
+		return newDoTUpstream(strings.TrimSpace(server), c.cfg, c.dialer, c.pins)
+	case strings.EqualFold(scheme, "https"):
+		if c.http == nil {
+			c.http = newDoHClient(c.cfg, c.dialer)
+		}
+
+		return newDoHUpstream(strings.TrimSpace(server), c.cfg, c.http)
+	default:
+		return nil, fmt.Errorf("invalid dns server %q, unsupported scheme %q", server, scheme)
+	}
+
+	addr, err := serverAddr(server)
+	if err != nil {
+		return nil, err
+	}
+
+	return &plainUpstream{addr: addr, ad: c.cfg.TrustAD}, nil
+}
+
+// Close closes the connections kept open to the DNS over TLS and DNS over HTTPS servers
+func (c *DNSClient) Close() error {
+	var errs []error
+	for _, u := range c.upstreams {
+		errs = append(errs, u.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// serverAddr returns the server as host:port, adding the default port if missing
+func serverAddr(server string) (string, error) {
+	server = strings.TrimSpace(server)
+	if server == "" {
+		return "", fmt.Errorf("empty dns server")
+	}
+
+	// bare ip, v4 or v6
+	if ip, err := netip.ParseAddr(strings.Trim(server, "[]")); err == nil {
+		return net.JoinHostPort(ip.String(), dnsPort), nil
+	}
+
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		// bare hostname
+		return net.JoinHostPort(server, dnsPort), nil
+	}
+
+	if host == "" || port == "" {
+		return "", fmt.Errorf("invalid dns server %q", server)
+	}
+
+	return server, nil
+}
+
+// LookupTXT returns the TXT records for name, each record's strings joined
+func (c *DNSClient) LookupTXT(ctx context.Context, name string) (TXTResult, error) {
+	msg, server, err := c.query(ctx, name, dnsmessage.TypeTXT)
+	if err != nil {
+		return TXTResult{}, err
+	}
+
+	// query only returns server failures that are bogus answers
+	if msg.Header.RCode == dnsmessage.RCodeServerFailure {
+		reason, _ := bogusReason(msg)
+
+		// the error may be shown to clients, the upstream is only logged
+		c.cfg.Logger.Warn("upstream reported bogus answer", "name", name, "upstream", server, "reason", reason)
+
+		return TXTResult{Security: SecurityBogus}, fmt.Errorf("%w: %s for %s", ErrBogus, reason, name)
+	}
+
+	security := c.security(msg)
+
+	if msg.Header.RCode == dnsmessage.RCodeNameError {
+		return TXTResult{TTL: negativeTTL(msg), Security: security}, nil
+	}
+
+	result := TXTResult{Security: security}
+	var ttl uint32
+
+	for i, answer := range msg.Answers {
+		// the answer is only as fresh as the shortest lived record in it, cnames included
+		if i == 0 || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+
+		if txt, ok := answer.Body.(*dnsmessage.TXTResource); ok {
+			result.Records = append(result.Records, joinTXT(txt.TXT))
+		}
+	}
+
+	// nodata
+	if len(result.Records) == 0 {
+		return TXTResult{TTL: negativeTTL(msg), Security: security}, nil
+	}
+
+	result.TTL = time.Duration(ttl) * time.Second
+	return result, nil
+}
+
+// security returns the DNSSEC status of a response, unknown unless the servers are trusted
+func (c *DNSClient) security(msg *dnsmessage.Message) SecurityStatus {
+	if !c.cfg.TrustAD {
+		return SecurityUnknown
+	}
+
+	if msg.Header.AuthenticData {
+		return SecuritySecure
+	}
+
+	return SecurityInsecure
+}
+
+// bogusReason returns the DNSSEC extended DNS error in a response, if there is one
+func bogusReason(msg *dnsmessage.Message) (string, bool) {
+	for _, additional := range msg.Additionals {
+		opt, ok := additional.Body.(*dnsmessage.OPTResource)
+		if !ok {
+			continue
+		}
+
+		for _, option := range opt.Options {
+			if option.Code != ednsExtendedError || len(option.Data) < 2 {
+				continue
+			}
+
+			reason, ok := bogusErrors[binary.BigEndian.Uint16(option.Data)]
+			if !ok {
+				continue
+			}
+
+			if text := option.Data[2:]; len(text) > 0 {
+				reason += ": " + string(text)
+			}
+
+			return reason, true
+		}
+	}
+
+	return "", false
+}
+
+// negativeTTL returns how long a missing answer may be cached,
+// the lower of the SOA record's TTL and its MINIMUM field as per RFC 2308.
+// Returns zero when the response has no SOA record
+func negativeTTL(msg *dnsmessage.Message) time.Duration {
+	for _, authority := range msg.Authorities {
+		if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+			return time.Duration(min(authority.Header.TTL, soa.MinTTL)) * time.Second
+		}
+	}
+
+	return 0
+}
+
+// query sends the question to the servers in turn until one gives a usable answer.
+// Servers with an open circuit go last. A server that fails passes the query on to the next,
+// and with HedgeDelay set so does a server slow to answer; the first usable answer wins
+func (c *DNSClient) query(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, string, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, "", &net.DNSError{Err: err.Error(), Name: name}
+	}
+
+	question := dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}
+
+	order := c.order()
+	total := len(order) * (c.cfg.Retries + 1)
+
+	// stops the queries still in flight once one of them is answered
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan attempt, total)
+	sent, inFlight := 0, 0
+
+	hedge := c.cfg.Clock.NewTimer(c.cfg.HedgeDelay)
+	hedge.Stop()
+	defer hedge.Stop()
+
+	send := func() {
+		i := order[sent%len(order)]
+		sent++
+		inFlight++
+
+		go func() {
+			results <- c.attempt(ctx, i, question)
+		}()
+
+		if c.cfg.HedgeDelay > 0 && sent < total {
+			hedge.Reset(c.cfg.HedgeDelay)
+		}
+	}
+
+	var lastErr error
+	var lastServer string
+
+	send()
+
+	for inFlight > 0 {
+		select {
+		case res := <-results:
+			inFlight--
+			lastServer = res.server
+
+			if res.err == nil {
+				return res.msg, res.server, nil
+			}
+
+			lastErr = res.err
+
+			if sent < total && ctx.Err() == nil {
+				send()
+			}
+		case <-hedge.C():
+			if sent < total && ctx.Err() == nil {
+				c.cfg.Logger.Debug("hedging upstream query", "name", name, "upstream", c.upstreams[order[sent%len(order)]].String())
+				send()
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, lastServer, &net.DNSError{Err: ctx.Err().Error(), Name: name, Server: lastServer, IsTimeout: true}
+	}
+
+	dnsErr := &net.DNSError{Err: lastErr.Error(), Name: name, Server: lastServer, IsTemporary: true}
+
+	var netErr net.Error
+	if errors.As(lastErr, &netErr) && netErr.Timeout() {
+		dnsErr.IsTimeout = true
+	}
+
+	return nil, lastServer, dnsErr
+}
+
+// attempt is the outcome of a query to one server
+type attempt struct {
+	server string
+	msg    *dnsmessage.Message
+	err    error
+}
+
+// attempt sends the question to the upstream at index i and records how it went
+func (c *DNSClient) attempt(ctx context.Context, i int, question dnsmessage.Question) attempt {
+	u, health := c.upstreams[i], c.health[i]
+
+	start := c.cfg.Clock.Now()
+	msg, err := c.exchange(ctx, u, question)
+	if err == nil {
+		err = c.usable(msg)
+	}
+
+	elapsed := c.cfg.Clock.Since(start)
+
+	switch {
+	case err == nil:
+		health.success(elapsed)
+	case ctx.Err() != nil:
+		// cancelled because another server answered first, or by the caller, it says nothing of the server
+	default:
+		health.failure(elapsed, err)
+	}
+
+	if err != nil {
+		msg = nil
+	}
+
+	return attempt{server: u.String(), msg: msg, err: err}
+}
+
+// usable returns why a response can't be given to the caller, nil if it can
+func (c *DNSClient) usable(msg *dnsmessage.Message) error {
+	switch msg.Header.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+		return nil
+	case dnsmessage.RCodeServerFailure:
+		// other validating servers would fail the same way
+		if _, bogus := bogusReason(msg); bogus && c.cfg.TrustAD {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("server returned %s", msg.Header.RCode)
+}
+
+// order returns the indexes of the upstreams in the order they are tried, those with an open circuit last.
+// A server whose circuit is due a probe is tried first, so the probe is sent
+func (c *DNSClient) order() []int {
+	order := make([]int, 0, len(c.upstreams))
+	var open []int
+	probe := -1
+
+	for i, health := range c.health {
+		switch {
+		case health.closed():
+			order = append(order, i)
+		case probe < 0 && health.probe():
+			probe = i
+		default:
+			open = append(open, i)
+		}
+	}
+
+	if probe >= 0 {
+		order = append([]int{probe}, order...)
+	}
+
+	return append(order, open...)
+}
+
+// ReportsSecurity returns whether answers carry a DNSSEC status, which needs TrustAD
+func (c *DNSClient) ReportsSecurity() bool {
+	return c.cfg.TrustAD
+}
+
+// Health returns the health of the upstream servers, in the configured order
+func (c *DNSClient) Health() []UpstreamHealth {
+	health := make([]UpstreamHealth, 0, len(c.health))
+	for _, h := range c.health {
+		health = append(health, h.report())
+	}
+
+	return health
+}
+
+// exchange sends a single query to u, bounded by the per-query timeout
+func (c *DNSClient) exchange(ctx context.Context, u upstream, question dnsmessage.Question) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+
+	return u.exchange(ctx, question)
+}
+
+// plainUpstream is a server queried over udp, retrying over tcp if the answer was truncated
+type plainUpstream struct {
+	addr string
+	ad   bool
+}
+
+func (u *plainUpstream) String() string {
+	return u.addr
+}
+
+func (u *plainUpstream) Close() error {
+	return nil
+}
+
+func (u *plainUpstream) exchange(ctx context.Context, question dnsmessage.Question) (*dnsmessage.Message, error) {
+	msg, err := u.exchangeConn(ctx, "udp", question)
+	if errors.Is(err, errTruncated) {
+		return u.exchangeConn(ctx, "tcp", question)
+	}
+
+	return msg, err
+}
+
+func (u *plainUpstream) exchangeConn(ctx context.Context, network string, question dnsmessage.Question) (*dnsmessage.Message, error) {
+	id := uint16(rand.Uint32())
+
+	query, err := newQuery(id, question, u.ad)
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// unblock reads if the context is cancelled before the deadline
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if network == "tcp" {
+		return exchangeStream(conn, id, question, query)
+	}
+
+	return exchangeDatagram(conn, id, question, query)
+}
+
+func exchangeDatagram(conn net.Conn, id uint16, question dnsmessage.Question, query []byte) (*dnsmessage.Message, error) {
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, udpPayloadSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		msg, err := parseResponse(buf[:n], id, question)
+		if err != nil {
+			// ignore stray or spoofed packets and keep waiting for ours
+			continue
+		}
+
+		if msg.Header.Truncated {
+			return nil, errTruncated
+		}
+
+		return msg, nil
+	}
+}
+
+func exchangeStream(conn net.Conn, id uint16, question dnsmessage.Question, query []byte) (*dnsmessage.Message, error) {
+	buf := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(buf, uint16(len(query)))
+	copy(buf[2:], query)
+
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	return parseResponse(resp, id, question)
+}
+
+// newQuery builds a recursive query for question with an EDNS0 record.
+// Setting ad asks the server to report whether the answer was validated, RFC 6840 section 5.7
+func newQuery(id uint16, question dnsmessage.Question, ad bool) ([]byte, error) {
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(udpPayloadSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true, AuthenticData: ad},
+		Questions: []dnsmessage.Question{question},
+		Additionals: []dnsmessage.Resource{
+			{Header: opt, Body: &dnsmessage.OPTResource{}},
+		},
+	}
+
+	return msg.Pack()
+}
+
+// parseResponse unpacks resp and checks that it answers the query we sent
+func parseResponse(resp []byte, id uint16, question dnsmessage.Question) (*dnsmessage.Message, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	if !msg.Header.Response || msg.Header.ID != id {
+		return nil, fmt.Errorf("unexpected response id")
+	}
+
+	// truncated responses may come without a question section
+	if len(msg.Questions) == 0 && msg.Header.Truncated {
+		return &msg, nil
+	}
+
+	if len(msg.Questions) != 1 ||
+		msg.Questions[0].Type != question.Type ||
+		!strings.EqualFold(msg.Questions[0].Name.String(), question.Name.String()) {
+		return nil, fmt.Errorf("response does not match question")
+	}
+
+	return &msg, nil
+}
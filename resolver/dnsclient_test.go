@@ -0,0 +1,467 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNSHandler builds the response for a query, the header id and question are filled in
+type fakeDNSHandler func(q dnsmessage.Question, tcp bool) dnsmessage.Message
+
+// fakeDNSServer is an in-process dns server listening on the same udp and tcp port
+type fakeDNSServer struct {
+	addr    string
+	udp     net.PacketConn
+	tcp     net.Listener
+	handler fakeDNSHandler
+	queries atomic.Int32
+
+	// ad is whether the last query had the AD bit set
+	ad atomic.Bool
+}
+
+func newFakeDNSServer(t *testing.T, handler fakeDNSHandler) *fakeDNSServer {
+	t.Helper()
+
+	s := &fakeDNSServer{handler: handler}
+
+	// the udp port may already be taken for tcp, try a few times
+	for i := 0; i < 10; i++ {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			udp.Close()
+			continue
+		}
+
+		s.udp, s.tcp, s.addr = udp, tcp, udp.LocalAddr().String()
+		break
+	}
+
+	if s.addr == "" {
+		t.Fatal("failed to listen on matching udp and tcp ports")
+	}
+
+	t.Cleanup(func() {
+		s.udp.Close()
+		s.tcp.Close()
+	})
+
+	go s.serveUDP()
+	go s.serveTCP()
+
+	return s
+}
+
+func (s *fakeDNSServer) respond(query []byte, tcp bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+
+	s.queries.Add(1)
+	s.ad.Store(msg.Header.AuthenticData)
+
+	resp := s.handler(msg.Questions[0], tcp)
+	resp.Header.ID = msg.Header.ID
+	resp.Header.Response = true
+	resp.Questions = msg.Questions
+
+	b, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+
+	return b
+}
+
+func (s *fakeDNSServer) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		if resp := s.respond(buf[:n], false); resp != nil {
+			s.udp.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (s *fakeDNSServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+
+			resp := s.respond(query, true)
+			out := make([]byte, 2+len(resp))
+			binary.BigEndian.PutUint16(out, uint16(len(resp)))
+			copy(out[2:], resp)
+			conn.Write(out)
+		}()
+	}
+}
+
+func txtAnswer(q dnsmessage.Question, ttl uint32, txt ...string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.TXTResource{TXT: txt},
+	}
+}
+
+func soaAuthority(ttl, minTTL uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body: &dnsmessage.SOAResource{
+			NS:     dnsmessage.MustNewName("ns.example.com."),
+			MBox:   dnsmessage.MustNewName("hostmaster.example.com."),
+			MinTTL: minTTL,
+		},
+	}
+}
+
+func newTestDNSClient(t *testing.T, servers ...string) *DNSClient {
+	t.Helper()
+
+	c, err := NewDNSClient(DNSClientConfig{
+		Servers: servers,
+		Timeout: time.Millisecond * 200,
+		Retries: 0,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestDNSClient_LookupTXT(t *testing.T) {
+	s := newFakeDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		return dnsmessage.Message{
+			Answers: []dnsmessage.Resource{
+				txtAnswer(q, 300, "v=srd1; dest=", "https://example.com"),
+				txtAnswer(q, 60, "unrelated"),
+			},
+		}
+	})
+
+	c := newTestDNSClient(t, s.addr)
+
+	result, err := c.LookupTXT(context.Background(), "_srd.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Records) != 2 || result.Records[0] != "v=srd1; dest=https://example.com" {
+		t.Errorf("LookupTXT() = %q, want joined record", result.Records)
+	}
+
+	if result.TTL != time.Second*60 {
+		t.Errorf("LookupTXT() ttl = %s, want lowest ttl 60s", result.TTL)
+	}
+}
+
+func TestDNSClient_Security(t *testing.T) {
+	s := newFakeDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		return dnsmessage.Message{
+			Header:  dnsmessage.Header{AuthenticData: strings.HasPrefix(q.Name.String(), "_srd.secure.")},
+			Answers: []dnsmessage.Resource{txtAnswer(q, 300, "v=srd1; dest=https://example.com")},
+		}
+	})
+
+	tests := []struct {
+		name    string
+		trustAD bool
+		want    SecurityStatus
+	}{
+		{name: "_srd.secure.example.com", trustAD: true, want: SecuritySecure},
+		{name: "_srd.insecure.example.com", trustAD: true, want: SecurityInsecure},
+		{name: "_srd.secure.example.com", trustAD: false, want: SecurityUnknown},
+	}
+
+	for _, tt := range tests {
+		c, err := NewDNSClient(DNSClientConfig{Servers: []string{s.addr}, Timeout: time.Millisecond * 200, TrustAD: tt.trustAD})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := c.LookupTXT(context.Background(), tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Security != tt.want {
+			t.Errorf("LookupTXT(%s) security = %s with trust ad %v, want %s", tt.name, result.Security, tt.trustAD, tt.want)
+		}
+
+		if s.ad.Load() != tt.trustAD {
+			t.Errorf("query ad = %v, want %v", s.ad.Load(), tt.trustAD)
+		}
+	}
+}
+
+func TestDNSClient_Bogus(t *testing.T) {
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(udpPayloadSize, dnsmessage.RCodeSuccess, false); err != nil {
+		t.Fatal(err)
+	}
+
+	bogus := newFakeDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		return dnsmessage.Message{
+			Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure},
+			Additionals: []dnsmessage.Resource{{
+				Header: opt,
+				Body: &dnsmessage.OPTResource{Options: []dnsmessage.Option{
+					{Code: ednsExtendedError, Data: append([]byte{0, 7}, "expired yesterday"...)},
+				}},
+			}},
+		}
+	})
+
+	next := newFakeDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		return dnsmessage.Message{Answers: []dnsmessage.Resource{txtAnswer(q, 300, "v=srd1; dest=https://example.com")}}
+	})
+
+	c, err := NewDNSClient(DNSClientConfig{Servers: []string{bogus.addr, next.addr}, Timeout: time.Millisecond * 200, TrustAD: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := c.LookupTXT(context.Background(), "_srd.example.com")
+	if !errors.Is(err, ErrBogus) || !strings.Contains(err.Error(), "signature expired: expired yesterday") {
+		t.Fatalf("LookupTXT() error = %v, want %v with the reason", err, ErrBogus)
+	}
+
+	if strings.Contains(err.Error(), bogus.addr) {
+		t.Errorf("LookupTXT() error = %v, want the upstream left out", err)
+	}
+
+	if result.Security != SecurityBogus {
+		t.Errorf("LookupTXT() security = %s, want bogus", result.Security)
+	}
+
+	if next.queries.Load() != 0 {
+		t.Errorf("next server queries = %d, want 0, bogus answers are final", next.queries.Load())
+	}
+
+	// without trusting the servers, a server failure is only a failure
+	c = newTestDNSClient(t, bogus.addr, next.addr)
+
+	if _, err := c.LookupTXT(context.Background(), "_srd.example.com"); err != nil {
+		t.Errorf("LookupTXT() = %v, want the next server's answer", err)
+	}
+}
+
+func TestDNSClient_TruncatedFallsBackToTCP(t *testing.T) {
+	s := newFakeDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		if !tcp {
+			return dnsmessage.Message{Header: dnsmessage.Header{Truncated: true}}
+		}
+
+		return dnsmessage.Message{
+			Answers: []dnsmessage.Resource{
+				txtAnswer(q, 300, "v=srd1; dest=https://"+strings.Repeat("a", 200)+".com"),
+			},
+		}
+	})
+
+	c := newTestDNSClient(t, s.addr)
+
+	result, err := c.LookupTXT(context.Background(), "_srd.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Records) != 1 || !strings.HasPrefix(result.Records[0], "v=srd1") {
+		t.Errorf("LookupTXT() = %q, want record over tcp", result.Records)
+	}
+}
+
+func TestDNSClient_LongRecord(t *testing.T) {
+	dest := "https://example.net/" + strings.Repeat("a", 400)
+	record := "v=srd1; dest=" + dest
+
+	s := newFakeDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		if !tcp {
+			return dnsmessage.Message{Header: dnsmessage.Header{Truncated: true}}
+		}
+
+		// split into character-strings of at most 255 bytes
+		return dnsmessage.Message{
+			Answers: []dnsmessage.Resource{txtAnswer(q, 300, record[:255], record[255:])},
+		}
+	})
+
+	c := newTestDNSClient(t, s.addr)
+
+	r := newTestResolver(t, c)
+
+	rr, err := r.Resolve(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.To != dest {
+		t.Errorf("Resolve() to = %q, want reassembled destination", rr.To)
+	}
+}
+
+func TestDNSClient_NotFound(t *testing.T) {
+	s := newFakeDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		return dnsmessage.Message{
+			Header:      dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+			Authorities: []dnsmessage.Resource{soaAuthority(3600, 120)},
+		}
+	})
+
+	c := newTestDNSClient(t, s.addr)
+
+	result, err := c.LookupTXT(context.Background(), "_srd.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Records) != 0 {
+		t.Errorf("LookupTXT() = %q, want no records", result.Records)
+	}
+
+	if result.TTL != time.Second*120 {
+		t.Errorf("LookupTXT() ttl = %s, want soa minimum 120s", result.TTL)
+	}
+}
+
+func TestDNSClient_NoData(t *testing.T) {
+	s := newFakeDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		return dnsmessage.Message{
+			Authorities: []dnsmessage.Resource{soaAuthority(30, 120)},
+		}
+	})
+
+	c := newTestDNSClient(t, s.addr)
+
+	result, err := c.LookupTXT(context.Background(), "_srd.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Records) != 0 {
+		t.Errorf("LookupTXT() = %q, want no records", result.Records)
+	}
+
+	if result.TTL != time.Second*30 {
+		t.Errorf("LookupTXT() ttl = %s, want soa ttl 30s", result.TTL)
+	}
+}
+
+func TestDNSClient_FailsOverToNextServer(t *testing.T) {
+	// a socket that never answers
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+
+	servfail := newFakeDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		return dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}}
+	})
+
+	ok := newFakeDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		return dnsmessage.Message{
+			Answers: []dnsmessage.Resource{txtAnswer(q, 300, "v=srd1; dest=https://example.com")},
+		}
+	})
+
+	c := newTestDNSClient(t, dead.LocalAddr().String(), servfail.addr, ok.addr)
+
+	result, err := c.LookupTXT(context.Background(), "_srd.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Records) != 1 {
+		t.Errorf("LookupTXT() = %q, want 1 record", result.Records)
+	}
+
+	if servfail.queries.Load() != 1 {
+		t.Errorf("servfail server queries = %d, want 1", servfail.queries.Load())
+	}
+}
+
+func TestDNSClient_Retries(t *testing.T) {
+	s := newFakeDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		return dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}}
+	})
+
+	c, err := NewDNSClient(DNSClientConfig{Servers: []string{s.addr}, Timeout: time.Millisecond * 200, Retries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.LookupTXT(context.Background(), "_srd.example.com")
+
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || dnsErr.IsNotFound {
+		t.Errorf("LookupTXT() error = %v, want temporary dns error", err)
+	}
+
+	if s.queries.Load() != 3 {
+		t.Errorf("queries = %d, want 3", s.queries.Load())
+	}
+}
+
+func TestServerAddr(t *testing.T) {
+	tests := []struct {
+		server string
+		want   string
+	}{
+		{server: "10.0.0.53", want: "10.0.0.53:53"},
+		{server: "10.0.0.53:5353", want: "10.0.0.53:5353"},
+		{server: "::1", want: "[::1]:53"},
+		{server: "[::1]", want: "[::1]:53"},
+		{server: "[::1]:5353", want: "[::1]:5353"},
+		{server: "dns.internal", want: "dns.internal:53"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			got, err := serverAddr(tt.server)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("serverAddr(%q) = %q, want %q", tt.server, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dohMediaType is the media type of DNS over HTTPS queries and responses, RFC 8484 section 6
+const dohMediaType = "application/dns-message"
+
+// maxMessageSize is the largest DNS message, the limit of the TCP length prefix
+const maxMessageSize = 65535
+
+// newDoHClient returns the HTTP client shared by the DNS over HTTPS endpoints.
+// It keeps connections open between queries and uses HTTP/2 when the server supports it,
+// which RFC 8484 section 5.2 recommends
+func newDoHClient(cfg DNSClientConfig, dialer *net.Dialer) *http.Client {
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     cfg.TLSConfig,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     cfg.IdleTimeout,
+		TLSHandshakeTimeout: time.Second * 5,
+	}
+
+	return &http.Client{Transport: transport}
+}
+
+// bootstrapResolver returns a resolver for the hostnames of DNS over TLS servers and DNS over HTTPS endpoints
+// that sends its queries to servers, each dial going to the next server
+func bootstrapResolver(servers []string) (*net.Resolver, error) {
+	addrs := make([]string, 0, len(servers))
+	for _, server := range servers {
+		addr, err := serverAddr(server)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootstrap server: %w", err)
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	var next atomic.Uint32
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			addr := addrs[int(next.Add(1)-1)%len(addrs)]
+			return d.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
+
+// dohUpstream is a DNS over HTTPS endpoint, RFC 8484
+type dohUpstream struct {
+	url    *url.URL
+	method string
+	ad     bool
+	client *http.Client
+}
+
+func newDoHUpstream(endpoint string, cfg DNSClientConfig, client *http.Client) (*dohUpstream, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns over https endpoint %q: %w", endpoint, err)
+	}
+
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid dns over https endpoint %q", endpoint)
+	}
+
+	return &dohUpstream{
+		url:    u,
+		method: cfg.DoHMethod,
+		ad:     cfg.TrustAD,
+		client: client,
+	}, nil
+}
+
+func (u *dohUpstream) String() string {
+	return u.url.String()
+}
+
+// Close closes the idle connections of the client, which are shared with the other endpoints
+func (u *dohUpstream) Close() error {
+	u.client.CloseIdleConnections()
+	return nil
+}
+
+func (u *dohUpstream) exchange(ctx context.Context, question dnsmessage.Question) (*dnsmessage.Message, error) {
+	// the id is 0 so identical queries are identical requests for HTTP caches, RFC 8484 section 4.1
+	query, err := newQuery(0, question, u.ad)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := u.request(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned http status %s", resp.Status)
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != dohMediaType {
+		return nil, fmt.Errorf("server returned content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(body) > maxMessageSize {
+		return nil, fmt.Errorf("response too large")
+	}
+
+	msg, err := parseResponse(body, 0, question)
+	if err != nil {
+		return nil, err
+	}
+
+	// the response may have been cached along the way, RFC 8484 section 5.1
+	if age, err := strconv.ParseUint(resp.Header.Get("Age"), 10, 32); err == nil && age > 0 {
+		decrementTTLs(msg, uint32(age))
+	}
+
+	return msg, nil
+}
+
+// request builds the HTTP request for a wire format query, RFC 8484 section 4.1
+func (u *dohUpstream) request(ctx context.Context, query []byte) (*http.Request, error) {
+	if u.method == http.MethodPost {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url.String(), bytes.NewReader(query))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", dohMediaType)
+		req.Header.Set("Accept", dohMediaType)
+		return req, nil
+	}
+
+	endpoint := *u.url
+	params := endpoint.Query()
+	params.Set("dns", base64.RawURLEncoding.EncodeToString(query))
+	endpoint.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", dohMediaType)
+	return req, nil
+}
+
+// decrementTTLs takes the time a response spent in a cache off its records' TTLs.
+// The additional section is left alone, its OPT record uses the TTL field for flags
+func decrementTTLs(msg *dnsmessage.Message, age uint32) {
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities} {
+		for i := range section {
+			section[i].Header.TTL -= min(section[i].Header.TTL, age)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDoHServer is an in-process DNS over HTTPS server speaking HTTP/2
+type fakeDoHServer struct {
+	*httptest.Server
+	dns *fakeDNSServer
+
+	// age is sent as the Age header when set
+	age string
+
+	conns  atomic.Int32
+	method atomic.Value
+	proto  atomic.Int32
+}
+
+func newFakeDoHServer(t *testing.T, handler fakeDNSHandler) *fakeDoHServer {
+	t.Helper()
+
+	s := &fakeDoHServer{dns: &fakeDNSServer{handler: handler}}
+
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serveHTTP))
+	s.EnableHTTP2 = true
+	s.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			s.conns.Add(1)
+		}
+	}
+
+	s.StartTLS()
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *fakeDoHServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.method.Store(r.Method)
+	s.proto.Store(int32(r.ProtoMajor))
+
+	if r.Header.Get("Accept") != dohMediaType {
+		http.Error(w, "bad accept header", http.StatusBadRequest)
+		return
+	}
+
+	var query []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		query, err = io.ReadAll(r.Body)
+	}
+
+	var msg dnsmessage.Message
+	if err != nil || msg.Unpack(query) != nil || msg.Header.ID != 0 {
+		http.Error(w, "bad query", http.StatusBadRequest)
+		return
+	}
+
+	resp := s.dns.respond(query, true)
+	if resp == nil {
+		http.Error(w, "bad query", http.StatusBadRequest)
+		return
+	}
+
+	if s.age != "" {
+		w.Header().Set("Age", s.age)
+	}
+
+	w.Header().Set("Content-Type", dohMediaType)
+	w.Write(resp)
+}
+
+// tlsConfig trusts the server's certificate
+func (s *fakeDoHServer) tlsConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	return &tls.Config{RootCAs: pool}
+}
+
+func newTestDoHClient(t *testing.T, s *fakeDoHServer, cfg DNSClientConfig) *DNSClient {
+	t.Helper()
+
+	if cfg.Servers == nil {
+		cfg.Servers = []string{s.URL + "/dns-query"}
+	}
+
+	cfg.Timeout = time.Second
+	cfg.TLSConfig = s.tlsConfig()
+
+	c, err := NewDNSClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func TestDoH_LookupTXT(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			s := newFakeDoHServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+				return dnsmessage.Message{Answers: []dnsmessage.Resource{txtAnswer(q, 300, "v=srd1; dest=https://example.com")}}
+			})
+
+			c := newTestDoHClient(t, s, DNSClientConfig{DoHMethod: method})
+
+			for i := 0; i < 3; i++ {
+				result, err := c.LookupTXT(context.Background(), "_srd.example.com")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(result.Records) != 1 || result.Records[0] != "v=srd1; dest=https://example.com" || result.TTL != time.Second*300 {
+					t.Fatalf("LookupTXT() = %+v", result)
+				}
+			}
+
+			if got := s.method.Load(); got != method {
+				t.Errorf("method = %v, want %s", got, method)
+			}
+
+			if got := s.proto.Load(); got != 2 {
+				t.Errorf("http version = %d, want 2", got)
+			}
+
+			if got := s.conns.Load(); got != 1 {
+				t.Errorf("connections = %d, want 1 reused by every query", got)
+			}
+		})
+	}
+}
+
+func TestDoH_NotFound(t *testing.T) {
+	s := newFakeDoHServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		return dnsmessage.Message{
+			Header:      dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+			Authorities: []dnsmessage.Resource{soaAuthority(3600, 60)},
+		}
+	})
+
+	c := newTestDoHClient(t, s, DNSClientConfig{})
+
+	result, err := c.LookupTXT(context.Background(), "_srd.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Records) != 0 || result.TTL != time.Minute {
+		t.Errorf("LookupTXT() = %+v, want no records with the negative ttl", result)
+	}
+}
+
+func TestDoH_Age(t *testing.T) {
+	s := newFakeDoHServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		return dnsmessage.Message{Answers: []dnsmessage.Resource{txtAnswer(q, 300, "v=srd1; dest=https://example.com")}}
+	})
+
+	c := newTestDoHClient(t, s, DNSClientConfig{})
+
+	for _, tt := range []struct {
+		age  string
+		want time.Duration
+	}{
+		{age: "", want: time.Second * 300},
+		{age: "100", want: time.Second * 200},
+		{age: "1000", want: 0},
+		{age: "bogus", want: time.Second * 300},
+	} {
+		s.age = tt.age
+
+		result, err := c.LookupTXT(context.Background(), "_srd.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.TTL != tt.want {
+			t.Errorf("LookupTXT() ttl = %s with age %q, want %s", result.TTL, tt.age, tt.want)
+		}
+	}
+}
+
+func TestDoH_Bootstrap(t *testing.T) {
+	s := newFakeDoHServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		return dnsmessage.Message{Answers: []dnsmessage.Resource{txtAnswer(q, 300, "v=srd1; dest=https://example.com")}}
+	})
+
+	// the test certificate is valid for example.com, which the bootstrap server resolves to the test server
+	bootstrap := newFakeDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		if q.Type != dnsmessage.TypeA || q.Name.String() != "example.com." {
+			return dnsmessage.Message{}
+		}
+
+		return dnsmessage.Message{Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+		}}}
+	})
+
+	_, port, err := net.SplitHostPort(s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestDoHClient(t, s, DNSClientConfig{
+		Servers:   []string{"https://example.com:" + port + "/dns-query"},
+		Bootstrap: []string{bootstrap.addr},
+	})
+
+	if _, err := c.LookupTXT(context.Background(), "_srd.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if bootstrap.queries.Load() == 0 {
+		t.Error("bootstrap server was not queried")
+	}
+}
+
+func TestDoH_FailsOverToNextServer(t *testing.T) {
+	s := newFakeDoHServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		return dnsmessage.Message{Answers: []dnsmessage.Resource{txtAnswer(q, 300, "v=srd1; dest=https://example.com")}}
+	})
+
+	plain := newFakeDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		return dnsmessage.Message{Answers: []dnsmessage.Resource{txtAnswer(q, 300, "v=srd1; dest=https://example.net")}}
+	})
+
+	c := newTestDoHClient(t, s, DNSClientConfig{
+		Servers: []string{s.URL + "/missing", plain.addr},
+	})
+
+	// the test server answers every path, only a wrong content type gets through
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	})
+
+	result, err := c.LookupTXT(context.Background(), "_srd.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Records) != 1 || result.Records[0] != "v=srd1; dest=https://example.net" {
+		t.Errorf("LookupTXT() = %+v, want the plain server's answer", result)
+	}
+
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+
+	c = newTestDoHClient(t, s, DNSClientConfig{Servers: []string{s.URL}})
+
+	_, err = c.LookupTXT(context.Background(), "_srd.example.com")
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("LookupTXT() error = %v, want the http status", err)
+	}
+}
+
+func TestNewDNSClient_DoHConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  DNSClientConfig
+	}{
+		{name: "http endpoint", cfg: DNSClientConfig{Servers: []string{"http://dns.example/dns-query"}}},
+		{name: "endpoint without host", cfg: DNSClientConfig{Servers: []string{"https:///dns-query"}}},
+		{name: "method", cfg: DNSClientConfig{Servers: []string{"https://dns.example/dns-query"}, DoHMethod: "PUT"}},
+		{name: "bootstrap", cfg: DNSClientConfig{Servers: []string{"https://dns.example/dns-query"}, Bootstrap: []string{""}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewDNSClient(tt.cfg); err == nil {
+				t.Error("NewDNSClient() error = nil, want an error")
+			}
+		})
+	}
+}
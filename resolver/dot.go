@@ -0,0 +1,382 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dotPort is the default port for DNS over TLS servers, RFC 7858 section 3.1
+const dotPort = "853"
+
+// errConnClosed is returned for queries pending on a connection that was closed
+var errConnClosed = errors.New("connection closed")
+
+// dotUpstream is a DNS over TLS server, RFC 7858.
+// Queries share one connection, sent without waiting for the previous answers,
+// which the server may send back in any order, RFC 7766 section 6.2.1.1.
+// The connection is closed once it was idle for the idle timeout
+type dotUpstream struct {
+	name   string
+	addr   string
+	tls    *tls.Config
+	dialer *net.Dialer
+	ad     bool
+	idle   time.Duration
+
+	mu   sync.Mutex
+	conn *dotConn
+}
+
+func newDoTUpstream(server string, cfg DNSClientConfig, dialer *net.Dialer, pins [][]byte) (*dotUpstream, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns over tls server %q: %w", server, err)
+	}
+
+	if u.Hostname() == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return nil, fmt.Errorf("invalid dns over tls server %q", server)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = dotPort
+	}
+
+	// the name to authenticate defaults to the host dialed
+	serverName := u.Fragment
+	if serverName == "" {
+		serverName = u.Hostname()
+	}
+
+	var config *tls.Config
+	if cfg.TLSConfig != nil {
+		config = cfg.TLSConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+
+	config.ServerName = serverName
+	config.MinVersion = max(config.MinVersion, tls.VersionTLS12)
+
+	if len(pins) > 0 {
+		// the out-of-band key-pinned privacy profile authenticates the server by its key alone
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifySPKIPins(state.PeerCertificates, pins)
+		}
+	}
+
+	addr := net.JoinHostPort(u.Hostname(), port)
+
+	name := "tls://" + addr
+	if u.Fragment != "" {
+		name += "#" + u.Fragment
+	}
+
+	return &dotUpstream{
+		name:   name,
+		addr:   addr,
+		tls:    config,
+		dialer: dialer,
+		ad:     cfg.TrustAD,
+		idle:   cfg.IdleTimeout,
+	}, nil
+}
+
+// verifySPKIPins checks that the server's key, or the key of a certificate its chain leads to, matches one of pins.
+// The handshake only proves the server holds the key of the first certificate, the others
+// are only trusted once the first is verified to chain up to a pinned one
+func verifySPKIPins(certs []*x509.Certificate, pins [][]byte) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("server presented no certificate")
+	}
+
+	if matchesSPKIPin(certs[0], pins) {
+		return nil
+	}
+
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	pinned := false
+
+	for _, cert := range certs[1:] {
+		if matchesSPKIPin(cert, pins) {
+			roots.AddCert(cert)
+			pinned = true
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+
+	if pinned {
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no server certificate matches the spki pins")
+}
+
+// matchesSPKIPin returns whether the certificate's public key matches one of pins
+func matchesSPKIPin(cert *x509.Certificate, pins [][]byte) bool {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	for _, pin := range pins {
+		if bytes.Equal(sum[:], pin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (u *dotUpstream) String() string {
+	return u.name
+}
+
+func (u *dotUpstream) Close() error {
+	u.mu.Lock()
+	conn := u.conn
+	u.conn = nil
+	u.mu.Unlock()
+
+	if conn != nil {
+		conn.close(errConnClosed)
+	}
+
+	return nil
+}
+
+func (u *dotUpstream) exchange(ctx context.Context, question dnsmessage.Question) (*dnsmessage.Message, error) {
+	conn, fresh, err := u.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := conn.exchange(ctx, question, u.ad)
+
+	// the server may have closed a connection we kept open, try once more on a new one
+	if errors.Is(err, errConnClosed) && !fresh && ctx.Err() == nil {
+		if conn, _, err = u.get(ctx); err != nil {
+			return nil, err
+		}
+
+		msg, err = conn.exchange(ctx, question, u.ad)
+	}
+
+	return msg, err
+}
+
+// get returns the open connection, dialing a new one when there is none.
+// fresh is whether the connection was dialed for this query
+func (u *dotUpstream) get(ctx context.Context) (conn *dotConn, fresh bool, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn != nil && !u.conn.closed() {
+		return u.conn, false, nil
+	}
+
+	d := tls.Dialer{NetDialer: u.dialer, Config: u.tls}
+
+	c, err := d.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	u.conn = newDoTConn(c, u.idle)
+	return u.conn, true, nil
+}
+
+// dotConn is a connection to a DNS over TLS server with the queries waiting for an answer
+type dotConn struct {
+	conn net.Conn
+	idle *time.Timer
+
+	// writeMu keeps queries from interleaving
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan []byte
+	err     error
+}
+
+func newDoTConn(conn net.Conn, idle time.Duration) *dotConn {
+	c := &dotConn{
+		conn:    conn,
+		pending: make(map[uint16]chan []byte),
+	}
+
+	c.idle = time.AfterFunc(idle, func() {
+		c.mu.Lock()
+		busy := len(c.pending) > 0
+		c.mu.Unlock()
+
+		if busy {
+			c.idle.Reset(idle)
+			return
+		}
+
+		c.close(errConnClosed)
+	})
+
+	go c.read(idle)
+
+	return c
+}
+
+// closed returns whether the connection was closed
+func (c *dotConn) closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err != nil
+}
+
+// close closes the connection, failing the pending queries with err
+func (c *dotConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+
+	c.err = err
+	c.idle.Stop()
+	c.conn.Close()
+
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// read hands the responses to the queries waiting for them until the connection is closed
+func (c *dotConn) read(idle time.Duration) {
+	for {
+		var length [2]byte
+		if _, err := io.ReadFull(c.conn, length[:]); err != nil {
+			c.close(fmt.Errorf("%w: %w", errConnClosed, err))
+			return
+		}
+
+		resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(c.conn, resp); err != nil {
+			c.close(fmt.Errorf("%w: %w", errConnClosed, err))
+			return
+		}
+
+		if len(resp) < 2 {
+			continue
+		}
+
+		id := binary.BigEndian.Uint16(resp)
+
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+
+		// answers to queries that gave up waiting are dropped
+		if ok {
+			ch <- resp
+			c.idle.Reset(idle)
+		}
+	}
+}
+
+// exchange sends a query for question and waits for its answer
+func (c *dotConn) exchange(ctx context.Context, question dnsmessage.Question, ad bool) (*dnsmessage.Message, error) {
+	ch := make(chan []byte, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	// the id tells the answers apart, it must not be in use by another pending query
+	id := uint16(rand.Uint32())
+	for _, ok := c.pending[id]; ok; _, ok = c.pending[id] {
+		id = uint16(rand.Uint32())
+	}
+
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	query, err := newQuery(id, question, ad)
+	if err != nil {
+		c.forget(id)
+		return nil, err
+	}
+
+	if err := c.write(ctx, query); err != nil {
+		err = fmt.Errorf("%w: %w", errConnClosed, err)
+		c.close(err)
+		return nil, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, c.closeErr()
+		}
+
+		return parseResponse(resp, id, question)
+	case <-ctx.Done():
+		c.forget(id)
+		return nil, ctx.Err()
+	}
+}
+
+// write sends a query with its length prefix, RFC 1035 section 4.2.2
+func (c *dotConn) write(ctx context.Context, query []byte) error {
+	buf := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(buf, uint16(len(query)))
+	copy(buf[2:], query)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	deadline, _ := ctx.Deadline()
+	c.conn.SetWriteDeadline(deadline)
+
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// forget stops waiting for the answer to the query with id
+func (c *dotConn) forget(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, id)
+}
+
+func (c *dotConn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
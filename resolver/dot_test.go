@@ -0,0 +1,382 @@
+package resolver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDoTServer is an in-process DNS over TLS server answering each query
+// on its own goroutine, so answers may come back out of order
+type fakeDoTServer struct {
+	addr string
+	cert *x509.Certificate
+	dns  *fakeDNSServer
+
+	// closeAfterAnswer closes connections after their first answer
+	closeAfterAnswer bool
+
+	conns  atomic.Int32
+	closed atomic.Int32
+}
+
+func newFakeDoTServer(t *testing.T, handler fakeDNSHandler) *fakeDoTServer {
+	t.Helper()
+
+	cert, leaf := newTestCertificate(t, nil)
+	return newFakeDoTServerWithCert(t, handler, cert, leaf)
+}
+
+// newFakeDoTServerWithCert is a fakeDoTServer presenting cert, leaf is the certificate it is trusted by
+func newFakeDoTServerWithCert(t *testing.T, handler fakeDNSHandler, cert tls.Certificate, leaf *x509.Certificate) *fakeDoTServer {
+	t.Helper()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	s := &fakeDoTServer{
+		addr: l.Addr().String(),
+		cert: leaf,
+		dns:  &fakeDNSServer{handler: handler},
+	}
+
+	go s.serve(l)
+
+	return s
+}
+
+func (s *fakeDoTServer) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.conns.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+func (s *fakeDoTServer) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.closed.Add(1)
+	}()
+
+	var writeMu sync.Mutex
+
+	for {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		answer := func() {
+			resp := s.dns.respond(query, true)
+			out := make([]byte, 2+len(resp))
+			binary.BigEndian.PutUint16(out, uint16(len(resp)))
+			copy(out[2:], resp)
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			conn.Write(out)
+		}
+
+		if s.closeAfterAnswer {
+			answer()
+			return
+		}
+
+		go answer()
+	}
+}
+
+// pin returns the SPKI pin of the server's certificate
+func (s *fakeDoTServer) pin() string {
+	sum := sha256.Sum256(s.cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// tlsConfig trusts the server's certificate
+func (s *fakeDoTServer) tlsConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.cert)
+
+	return &tls.Config{RootCAs: pool}
+}
+
+// newTestCertificate returns a certificate for 127.0.0.1 and dns.test, signed by parent or self-signed when parent is nil
+func newTestCertificate(t *testing.T, parent *tls.Certificate) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.test"},
+		DNSNames:              []string{"dns.test"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	signer, signerKey := template, any(key)
+	if parent != nil {
+		template.SerialNumber = big.NewInt(2)
+		template.IsCA = false
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, leaf
+}
+
+func newTestDoTClient(t *testing.T, cfg DNSClientConfig) *DNSClient {
+	t.Helper()
+
+	cfg.Timeout = time.Second
+
+	c, err := NewDNSClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+// echoTXT answers with a TXT record holding the query name, slowest for the first names
+func echoTXT(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+	var n int
+	fmt.Sscanf(q.Name.String(), "_srd.host%d.", &n)
+	time.Sleep(time.Millisecond * time.Duration(20-n))
+
+	return dnsmessage.Message{Answers: []dnsmessage.Resource{txtAnswer(q, 300, q.Name.String())}}
+}
+
+func TestDoT_LookupTXT(t *testing.T) {
+	s := newFakeDoTServer(t, echoTXT)
+	c := newTestDoTClient(t, DNSClientConfig{Servers: []string{"tls://" + s.addr}, TLSConfig: s.tlsConfig()})
+
+	for i := 0; i < 3; i++ {
+		result, err := c.LookupTXT(context.Background(), "_srd.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(result.Records) != 1 || result.Records[0] != "_srd.example.com." || result.TTL != time.Second*300 {
+			t.Fatalf("LookupTXT() = %+v", result)
+		}
+	}
+
+	if got := s.conns.Load(); got != 1 {
+		t.Errorf("connections = %d, want 1 reused by every query", got)
+	}
+}
+
+func TestDoT_Pipelining(t *testing.T) {
+	s := newFakeDoTServer(t, echoTXT)
+	c := newTestDoTClient(t, DNSClientConfig{Servers: []string{"tls://" + s.addr}, TLSConfig: s.tlsConfig()})
+
+	// open the connection first so the concurrent queries share it
+	if _, err := c.LookupTXT(context.Background(), "_srd.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			name := fmt.Sprintf("_srd.host%d.example.com", i)
+
+			result, err := c.LookupTXT(context.Background(), name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if len(result.Records) != 1 || result.Records[0] != name+"." {
+				t.Errorf("LookupTXT(%s) = %v, want its own answer", name, result.Records)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if got := s.conns.Load(); got != 1 {
+		t.Errorf("connections = %d, want 1 shared by the concurrent queries", got)
+	}
+}
+
+func TestDoT_SPKIPins(t *testing.T) {
+	s := newFakeDoTServer(t, echoTXT)
+
+	other := sha256.Sum256([]byte("another key"))
+
+	// a server with its own key presenting the pinned certificate, which is public, after its own
+	attackerCert, _ := newTestCertificate(t, nil)
+	attackerCert.Certificate = append(attackerCert.Certificate, s.cert.Raw)
+	attacker := newFakeDoTServerWithCert(t, echoTXT, attackerCert, s.cert)
+
+	// a server whose certificate is signed by a pinned ca
+	caCert, ca := newTestCertificate(t, nil)
+	leafCert, _ := newTestCertificate(t, &caCert)
+	leafCert.Certificate = append(leafCert.Certificate, ca.Raw)
+	signed := newFakeDoTServerWithCert(t, echoTXT, leafCert, ca)
+	caPin := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+
+	tests := []struct {
+		name    string
+		server  string
+		pins    []string
+		tls     *tls.Config
+		wantErr string
+	}{
+		{name: "pinned", server: "tls://" + s.addr, pins: []string{s.pin()}},
+		{name: "pinned among others", server: "tls://" + s.addr, pins: []string{base64.StdEncoding.EncodeToString(other[:]), s.pin()}},
+		{name: "wrong pin", server: "tls://" + s.addr, pins: []string{base64.StdEncoding.EncodeToString(other[:])}, tls: s.tlsConfig(), wantErr: "spki pins"},
+		{name: "pinned certificate after another key", server: "tls://" + attacker.addr, pins: []string{s.pin()}, wantErr: "spki pins"},
+		{name: "pinned ca", server: "tls://" + signed.addr, pins: []string{base64.StdEncoding.EncodeToString(caPin[:])}},
+		{name: "untrusted", server: "tls://" + s.addr, wantErr: "certificate"},
+		{name: "trusted", server: "tls://" + s.addr, tls: s.tlsConfig()},
+		{name: "trusted name", server: "tls://" + s.addr + "#dns.test", tls: s.tlsConfig()},
+		{name: "wrong name", server: "tls://" + s.addr + "#other.test", tls: s.tlsConfig(), wantErr: "certificate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestDoTClient(t, DNSClientConfig{Servers: []string{tt.server}, SPKIPins: tt.pins, TLSConfig: tt.tls})
+
+			_, err := c.LookupTXT(context.Background(), "_srd.example.com")
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("LookupTXT() error = %v", err)
+			}
+
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("LookupTXT() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDoT_Reconnects(t *testing.T) {
+	s := newFakeDoTServer(t, echoTXT)
+	s.closeAfterAnswer = true
+
+	c := newTestDoTClient(t, DNSClientConfig{Servers: []string{"tls://" + s.addr}, TLSConfig: s.tlsConfig()})
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.LookupTXT(context.Background(), "_srd.example.com"); err != nil {
+			t.Fatalf("LookupTXT() after the server closed the connection: %v", err)
+		}
+	}
+
+	if got := s.conns.Load(); got != 3 {
+		t.Errorf("connections = %d, want 3", got)
+	}
+}
+
+func TestDoT_IdleTimeout(t *testing.T) {
+	s := newFakeDoTServer(t, echoTXT)
+	c := newTestDoTClient(t, DNSClientConfig{
+		Servers:     []string{"tls://" + s.addr},
+		TLSConfig:   s.tlsConfig(),
+		IdleTimeout: time.Millisecond * 50,
+	})
+
+	if _, err := c.LookupTXT(context.Background(), "_srd.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool { return s.closed.Load() == 1 })
+
+	if _, err := c.LookupTXT(context.Background(), "_srd.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := s.conns.Load(); got != 2 {
+		t.Errorf("connections = %d, want a new one after the idle timeout", got)
+	}
+}
+
+func TestNewDNSClient_DoTConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  DNSClientConfig
+	}{
+		{name: "path", cfg: DNSClientConfig{Servers: []string{"tls://dns.example/dns-query"}}},
+		{name: "no host", cfg: DNSClientConfig{Servers: []string{"tls://:853"}}},
+		{name: "pin", cfg: DNSClientConfig{Servers: []string{"tls://dns.example"}, SPKIPins: []string{"not base64"}}},
+		{name: "short pin", cfg: DNSClientConfig{Servers: []string{"tls://dns.example"}, SPKIPins: []string{"AAAA"}}},
+		{name: "scheme", cfg: DNSClientConfig{Servers: []string{"quic://dns.example"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewDNSClient(tt.cfg); err == nil {
+				t.Error("NewDNSClient() error = nil, want an error")
+			}
+		})
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a second
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+
+		time.Sleep(time.Millisecond * 5)
+	}
+}
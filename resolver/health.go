@@ -0,0 +1,163 @@
+package resolver
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/twopow/srd/internal/clock"
+)
+
+const (
+	// latencyGain is the weight of a new sample in the smoothed latency, as for TCP's SRTT, RFC 6298
+	latencyGain = 0.125
+
+	// errorRateGain is the weight of a new query in the smoothed error rate
+	errorRateGain = 0.1
+)
+
+// UpstreamHealth is the health of an upstream server as tracked by the lookup backend
+type UpstreamHealth struct {
+	Server string
+
+	// Latency is the smoothed response time of the server's answers
+	Latency time.Duration
+
+	// ErrorRate is the smoothed share of queries the server failed, from 0 to 1
+	ErrorRate float64
+
+	Queries  uint64
+	Failures uint64
+
+	// CircuitOpen is set while the server keeps failing, it is then only tried after the others
+	CircuitOpen bool
+
+	LastError string
+}
+
+// HealthReporter is implemented by lookup backends that track the health of their upstream servers
+type HealthReporter interface {
+	Health() []UpstreamHealth
+}
+
+// upstreamHealth tracks the answers of a server and opens its circuit after
+// threshold consecutive failures. Once open, the circuit lets a single query through
+// every cooldown, which closes it again when the server answers
+type upstreamHealth struct {
+	server    string
+	threshold int
+	cooldown  time.Duration
+	clock     clock.Clock
+	logger    *slog.Logger
+
+	mu          sync.Mutex
+	latency     time.Duration
+	errorRate   float64
+	queries     uint64
+	failures    uint64
+	consecutive int
+	lastErr     string
+
+	// openUntil is when the open circuit lets the next query through, zero while closed
+	openUntil time.Time
+}
+
+// closed returns whether the server's circuit is closed
+func (h *upstreamHealth) closed() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.openUntil.IsZero()
+}
+
+// probe claims the query the open circuit lets through once its cooldown has passed.
+// It returns false while the circuit waits, the caller must send the query when it returns true
+func (h *upstreamHealth) probe() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.clock.Now()
+	if h.openUntil.IsZero() || now.Before(h.openUntil) {
+		return false
+	}
+
+	// the next query waits for another cooldown
+	h.openUntil = now.Add(h.cooldown)
+	return true
+}
+
+// success records an answer from the server
+func (h *upstreamHealth) success(elapsed time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.record(elapsed, false)
+	h.consecutive = 0
+
+	if !h.openUntil.IsZero() {
+		h.openUntil = time.Time{}
+		h.logger.Info("upstream circuit closed", "upstream", h.server, "latency", h.latency.Milliseconds())
+	}
+}
+
+// failure records a query the server failed to answer
+func (h *upstreamHealth) failure(elapsed time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.record(elapsed, true)
+	h.failures++
+	h.consecutive++
+	h.lastErr = err.Error()
+
+	if h.threshold <= 0 || h.consecutive < h.threshold {
+		return
+	}
+
+	if h.openUntil.IsZero() {
+		h.logger.Warn("upstream circuit opened", "upstream", h.server, "failures", h.consecutive, "errorRate", h.errorRate, "error", err)
+	}
+
+	h.openUntil = h.clock.Now().Add(h.cooldown)
+}
+
+func (h *upstreamHealth) record(elapsed time.Duration, failed bool) {
+	var sample float64
+	if failed {
+		sample = 1
+	}
+
+	if h.queries == 0 {
+		h.errorRate = sample
+	} else {
+		h.errorRate += (sample - h.errorRate) * errorRateGain
+	}
+
+	h.queries++
+
+	// only answers are timed, failures show in the error rate
+	if failed {
+		return
+	}
+
+	if h.latency == 0 {
+		h.latency = elapsed
+	} else {
+		h.latency += time.Duration(float64(elapsed-h.latency) * latencyGain)
+	}
+}
+
+func (h *upstreamHealth) report() UpstreamHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return UpstreamHealth{
+		Server:      h.server,
+		Latency:     h.latency,
+		ErrorRate:   h.errorRate,
+		Queries:     h.queries,
+		Failures:    h.failures,
+		CircuitOpen: !h.openUntil.IsZero(),
+		LastError:   h.lastErr,
+	}
+}
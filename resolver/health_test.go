@@ -0,0 +1,297 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/twopow/srd/internal/clock"
+)
+
+func answerTXT(dest string) fakeDNSHandler {
+	return func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		return dnsmessage.Message{Answers: []dnsmessage.Resource{txtAnswer(q, 300, "v=srd1; dest="+dest)}}
+	}
+}
+
+func TestDNSClient_Hedging(t *testing.T) {
+	tests := []struct {
+		name  string
+		hedge time.Duration
+		want  string
+	}{
+		{name: "hedged", hedge: time.Millisecond * 20, want: "v=srd1; dest=https://fast.example"},
+		{name: "not hedged", want: "v=srd1; dest=https://slow.example"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the slow server answers once it is released
+			gate := make(chan struct{})
+			release := sync.OnceFunc(func() { close(gate) })
+
+			slow := newFakeDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+				<-gate
+				return answerTXT("https://slow.example")(q, tcp)
+			})
+
+			t.Cleanup(release)
+
+			fast := newFakeDNSServer(t, answerTXT("https://fast.example"))
+
+			clk := clock.NewFake(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+
+			c, err := NewDNSClient(DNSClientConfig{
+				Servers:    []string{slow.addr, fast.addr},
+				Timeout:    time.Second * 5,
+				HedgeDelay: tt.hedge,
+				Clock:      clk,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			type lookup struct {
+				result TXTResult
+				err    error
+			}
+
+			done := make(chan lookup, 1)
+
+			go func() {
+				result, err := c.LookupTXT(context.Background(), "_srd.example.com")
+				done <- lookup{result, err}
+			}()
+
+			waitFor(t, func() bool { return slow.queries.Load() == 1 })
+
+			if tt.hedge > 0 {
+				// the hedge timer may only be set after the slow server got the query
+				waitFor(t, func() bool {
+					clk.Advance(tt.hedge)
+					return fast.queries.Load() == 1
+				})
+			} else {
+				clk.Advance(time.Hour)
+				release()
+			}
+
+			res := <-done
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+
+			if len(res.result.Records) != 1 || res.result.Records[0] != tt.want {
+				t.Fatalf("LookupTXT() = %v, want %q", res.result.Records, tt.want)
+			}
+
+			if tt.hedge == 0 && fast.queries.Load() != 0 {
+				t.Errorf("fast server queries = %d, want 0 without hedging", fast.queries.Load())
+			}
+		})
+	}
+}
+
+func TestDNSClient_CircuitBreaker(t *testing.T) {
+	var broken atomic.Bool
+	broken.Store(true)
+
+	flaky := newFakeDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		if broken.Load() {
+			return dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}}
+		}
+
+		return answerTXT("https://flaky.example")(q, tcp)
+	})
+
+	ok := newFakeDNSServer(t, answerTXT("https://ok.example"))
+
+	clk := clock.NewFake(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	c, err := NewDNSClient(DNSClientConfig{
+		Servers:          []string{flaky.addr, ok.addr},
+		Timeout:          time.Millisecond * 200,
+		CircuitThreshold: 2,
+		CircuitCooldown:  time.Minute,
+		Clock:            clk,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(want string) {
+		t.Helper()
+
+		result, err := c.LookupTXT(context.Background(), "_srd.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(result.Records) != 1 || result.Records[0] != "v=srd1; dest="+want {
+			t.Fatalf("LookupTXT() = %v, want %s", result.Records, want)
+		}
+	}
+
+	// two failures open the circuit
+	lookup("https://ok.example")
+	lookup("https://ok.example")
+
+	health := c.Health()
+	if !health[0].CircuitOpen || health[0].Failures != 2 || health[0].LastError != "server returned RCodeServerFailure" {
+		t.Fatalf("Health() = %+v, want the first server's circuit open", health[0])
+	}
+
+	if health[1].CircuitOpen || health[1].Queries != 2 || health[1].ErrorRate != 0 {
+		t.Fatalf("Health() = %+v, want the second server healthy", health[1])
+	}
+
+	// the open circuit sends queries to the other server first
+	lookup("https://ok.example")
+
+	if got := flaky.queries.Load(); got != 2 {
+		t.Errorf("flaky server queries = %d, want 2", got)
+	}
+
+	// after the cooldown a query probes the server, which closes the circuit once it answers
+	broken.Store(false)
+	clk.Advance(time.Minute)
+
+	lookup("https://flaky.example")
+
+	if health := c.Health(); health[0].CircuitOpen {
+		t.Errorf("Health() = %+v, want the circuit closed", health[0])
+	}
+}
+
+func TestDNSClient_Probe(t *testing.T) {
+	ok := newFakeDNSServer(t, answerTXT("https://ok.example"))
+	recovered := newFakeDNSServer(t, answerTXT("https://recovered.example"))
+
+	clk := clock.NewFake(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	c, err := NewDNSClient(DNSClientConfig{
+		Servers:         []string{ok.addr, recovered.addr},
+		Timeout:         time.Second,
+		CircuitCooldown: time.Minute,
+		Clock:           clk,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second server's circuit was opened by earlier failures
+	c.health[1].openUntil = clk.Now().Add(time.Minute)
+
+	lookup := func(want string) {
+		t.Helper()
+
+		result, err := c.LookupTXT(context.Background(), "_srd.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(result.Records) != 1 || result.Records[0] != "v=srd1; dest="+want {
+			t.Fatalf("LookupTXT() = %v, want %s", result.Records, want)
+		}
+	}
+
+	lookup("https://ok.example")
+
+	if got := recovered.queries.Load(); got != 0 {
+		t.Fatalf("recovered server queries = %d, want 0 during the cooldown", got)
+	}
+
+	// the probe goes out first, even though the server comes after a healthy one
+	clk.Advance(time.Minute)
+	lookup("https://recovered.example")
+
+	if health := c.Health(); health[1].CircuitOpen {
+		t.Errorf("Health() = %+v, want the circuit closed by the probe", health[1])
+	}
+}
+
+func TestDNSClient_OpenCircuitsAreStillTried(t *testing.T) {
+	var broken atomic.Bool
+	broken.Store(true)
+
+	s := newFakeDNSServer(t, func(q dnsmessage.Question, tcp bool) dnsmessage.Message {
+		if broken.Load() {
+			return dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}}
+		}
+
+		return answerTXT("https://example.net")(q, tcp)
+	})
+
+	c, err := NewDNSClient(DNSClientConfig{
+		Servers:          []string{s.addr},
+		Timeout:          time.Millisecond * 200,
+		CircuitThreshold: 1,
+		CircuitCooldown:  time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.LookupTXT(context.Background(), "_srd.example.com"); err == nil {
+		t.Fatal("LookupTXT() error = nil, want the server failure")
+	}
+
+	broken.Store(false)
+
+	// with no other server to turn to, the server is queried despite its open circuit
+	if _, err := c.LookupTXT(context.Background(), "_srd.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if health := c.Health(); health[0].CircuitOpen {
+		t.Errorf("Health() = %+v, want the circuit closed", health[0])
+	}
+}
+
+func TestUpstreamHealth_Record(t *testing.T) {
+	h := &upstreamHealth{server: "10.0.0.53:53", clock: clock.Real}
+
+	h.record(time.Millisecond*80, false)
+	if h.latency != time.Millisecond*80 || h.errorRate != 0 {
+		t.Fatalf("first sample: latency = %s, error rate = %f", h.latency, h.errorRate)
+	}
+
+	h.record(time.Millisecond*160, false)
+	if h.latency != time.Millisecond*90 {
+		t.Errorf("latency = %s, want 90ms", h.latency)
+	}
+
+	// failures count towards the error rate only
+	h.record(time.Second, true)
+	if h.latency != time.Millisecond*90 || h.errorRate != errorRateGain {
+		t.Errorf("after a failure: latency = %s, error rate = %f", h.latency, h.errorRate)
+	}
+
+	if h.queries != 3 {
+		t.Errorf("queries = %d, want 3", h.queries)
+	}
+}
+
+func TestResolver_Upstreams(t *testing.T) {
+	s := newFakeDNSServer(t, answerTXT("https://example.net"))
+	c := newTestDNSClient(t, s.addr)
+
+	r := newTestResolver(t, c)
+
+	if _, err := r.Resolve(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	upstreams := r.Upstreams()
+	if len(upstreams) != 1 || upstreams[0].Server != s.addr || upstreams[0].Queries != 1 {
+		t.Errorf("Upstreams() = %+v, want the dns client's server", upstreams)
+	}
+
+	if upstreams := newTestResolver(t, &fakeLookuper{}).Upstreams(); upstreams != nil {
+		t.Errorf("Upstreams() = %+v, want nil for backends without health", upstreams)
+	}
+}
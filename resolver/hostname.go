@@ -0,0 +1,97 @@
+package resolver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/twopow/srd/internal/util"
+	"golang.org/x/net/idna"
+)
+
+// maxHostnameLength is the longest hostname that fits in a DNS name, RFC 1035 section 2.3.4
+const maxHostnameLength = 253
+
+// NormalizeHostname returns the hostname a request is for, as used for lookups and cache keys.
+// Surrounding whitespace, the port and a trailing dot are removed and the hostname is lowercased.
+// Internationalized hostnames are converted to their ASCII form (A-labels) per UTS #46,
+// so bücher.example and xn--bcher-kva.example are the same hostname.
+// IP addresses, IPv4 or IPv6, return ErrHostIsIp with the address,
+// hostnames that aren't valid DNS names return ErrInvalidHostname
+func NormalizeHostname(hostname string) (string, error) {
+	host := strings.TrimSpace(hostname)
+	host = util.StripPort(host)
+	host = strings.ToLower(host)
+
+	if util.IsIp(host) {
+		return host, ErrHostIsIp
+	}
+
+	host = strings.TrimSuffix(host, ".")
+
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return host, fmt.Errorf("%w %q: %w", ErrInvalidHostname, hostname, err)
+	}
+
+	// a trailing ideographic full stop is only a dot once mapped
+	host = strings.TrimSuffix(ascii, ".")
+
+	if err := validateHostname(host); err != nil {
+		return host, fmt.Errorf("%w %q: %w", ErrInvalidHostname, hostname, err)
+	}
+
+	return host, nil
+}
+
+// validateHostname checks a lowercased hostname against the label syntax of RFC 1123 section 2.1,
+// letters, digits and hyphens, not starting or ending with a hyphen.
+// The top-level label can't be all digits, RFC 3696 section 2
+func validateHostname(host string) error {
+	if host == "" {
+		return fmt.Errorf("empty hostname")
+	}
+
+	if len(host) > maxHostnameLength {
+		return fmt.Errorf("longer than %d characters", maxHostnameLength)
+	}
+
+	labels := strings.Split(host, ".")
+
+	for _, label := range labels {
+		if label == "" {
+			return fmt.Errorf("empty label")
+		}
+
+		if len(label) > 63 {
+			return fmt.Errorf("label %q is longer than 63 characters", label)
+		}
+
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("label %q starts or ends with a hyphen", label)
+		}
+
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return fmt.Errorf("label %q contains %q", label, c)
+			}
+		}
+	}
+
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return fmt.Errorf("top-level label %q is numeric", labels[len(labels)-1])
+	}
+
+	return nil
+}
+
+// UnicodeHostname returns the Unicode form of an internationalized hostname, for display.
+// Other hostnames are returned as they are
+func UnicodeHostname(host string) string {
+	unicode, err := idna.Lookup.ToUnicode(host)
+	if err != nil {
+		return host
+	}
+
+	return unicode
+}
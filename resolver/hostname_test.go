@@ -0,0 +1,131 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeHostname(t *testing.T) {
+	tests := []struct {
+		hostname string
+		want     string
+		wantErr  error
+	}{
+		{hostname: "example.com", want: "example.com"},
+		{hostname: "  Example.COM  ", want: "example.com"},
+		{hostname: "example.com:8080", want: "example.com"},
+		{hostname: "example.com.", want: "example.com"},
+		{hostname: "example.com.:8080", want: "example.com"},
+		{hostname: "xn--bcher-kva.example", want: "xn--bcher-kva.example"},
+		{hostname: "a-b.c1.example", want: "a-b.c1.example"},
+		{hostname: "bücher.example", want: "xn--bcher-kva.example"},
+		{hostname: "BÜCHER.example.:8080", want: "xn--bcher-kva.example"},
+		{hostname: "bücher。example。", want: "xn--bcher-kva.example"},
+		{hostname: "straße.example", want: "xn--strae-oqa.example"},
+		{hostname: "xn--bcher-kva.example", want: "xn--bcher-kva.example"},
+		{hostname: "xn--bcher-kv.example", wantErr: ErrInvalidHostname},
+		{hostname: "127.0.0.1", want: "127.0.0.1", wantErr: ErrHostIsIp},
+		{hostname: "127.0.0.1:8080", want: "127.0.0.1", wantErr: ErrHostIsIp},
+		{hostname: "::1", want: "::1", wantErr: ErrHostIsIp},
+		{hostname: "[::1]:8080", want: "[::1]", wantErr: ErrHostIsIp},
+		{hostname: "[2001:DB8::1]", want: "[2001:db8::1]", wantErr: ErrHostIsIp},
+		{hostname: "", wantErr: ErrInvalidHostname},
+		{hostname: ".", wantErr: ErrInvalidHostname},
+		{hostname: "example..com", wantErr: ErrInvalidHostname},
+		{hostname: "-example.com", wantErr: ErrInvalidHostname},
+		{hostname: "example-.com", wantErr: ErrInvalidHostname},
+		{hostname: "exa_mple.com", wantErr: ErrInvalidHostname},
+		{hostname: "exa mple.com", wantErr: ErrInvalidHostname},
+		{hostname: "example.com/path", wantErr: ErrInvalidHostname},
+		{hostname: "256.1.1.1", wantErr: ErrInvalidHostname},
+		{hostname: strings.Repeat("a", 64) + ".com", wantErr: ErrInvalidHostname},
+		{hostname: strings.Repeat("a.", 127) + "com", wantErr: ErrInvalidHostname},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			got, err := NormalizeHostname(tt.hostname)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NormalizeHostname(%q) error = %v, want %v", tt.hostname, err, tt.wantErr)
+			}
+
+			if tt.want != "" && got != tt.want {
+				t.Errorf("NormalizeHostname(%q) = %q, want %q", tt.hostname, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnicodeHostname(t *testing.T) {
+	tests := map[string]string{
+		"xn--bcher-kva.example": "bücher.example",
+		"example.com":           "example.com",
+		"[::1]":                 "[::1]",
+	}
+
+	for host, want := range tests {
+		if got := UnicodeHostname(host); got != want {
+			t.Errorf("UnicodeHostname(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestResolve_IDN(t *testing.T) {
+	lookuper := &fakeLookuper{records: map[string][]string{"_srd.xn--bcher-kva.example": {"v=srd1; dest=https://Café.example:8443/Menu?q=É"}}}
+	r := newTestResolver(t, lookuper)
+
+	for _, hostname := range []string{"bücher.example", "xn--bcher-kva.example"} {
+		rr, err := r.Resolve(context.Background(), hostname)
+		if err != nil {
+			t.Fatalf("Resolve(%q) = %v", hostname, err)
+		}
+
+		if rr.To != "https://xn--caf-dma.example:8443/Menu?q=É" {
+			t.Errorf("Resolve(%q) to = %q, want the host in ascii form", hostname, rr.To)
+		}
+
+		if rr.UnicodeTo() != "https://café.example:8443/Menu?q=É" {
+			t.Errorf("UnicodeTo() = %q, want the host in unicode form", rr.UnicodeTo())
+		}
+	}
+
+	if lookuper.calls.Load() != 1 {
+		t.Errorf("lookuper calls = %d, want 1, both forms should share a cache key", lookuper.calls.Load())
+	}
+}
+
+func TestResolve_NormalizesHostname(t *testing.T) {
+	lookuper := &fakeLookuper{records: map[string][]string{"_srd.example.com": {"v=srd1; dest=https://example.net"}}}
+	r := newTestResolver(t, lookuper)
+
+	for _, hostname := range []string{"example.com", "Example.com.", "example.com:8080", " example.com. "} {
+		rr, err := r.Resolve(context.Background(), hostname)
+		if err != nil {
+			t.Fatalf("Resolve(%q) = %v", hostname, err)
+		}
+
+		if rr.To != "https://example.net" {
+			t.Errorf("Resolve(%q) to = %q, want https://example.net", hostname, rr.To)
+		}
+	}
+
+	if lookuper.calls.Load() != 1 {
+		t.Errorf("lookuper calls = %d, want 1, hostnames should share a cache key", lookuper.calls.Load())
+	}
+
+	for _, hostname := range []string{"::1", "[::1]:8080", "10.0.0.1:80"} {
+		if _, err := r.Resolve(context.Background(), hostname); !errors.Is(err, ErrHostIsIp) {
+			t.Errorf("Resolve(%q) error = %v, want %v", hostname, err, ErrHostIsIp)
+		}
+	}
+
+	if _, err := r.Resolve(context.Background(), "bad_host.example"); !errors.Is(err, ErrInvalidHostname) {
+		t.Errorf("Resolve() error = %v, want %v", err, ErrInvalidHostname)
+	}
+
+	if lookuper.calls.Load() != 1 {
+		t.Errorf("lookuper calls = %d, want 1, ips and invalid hostnames should not be looked up", lookuper.calls.Load())
+	}
+}
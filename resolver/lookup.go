@@ -0,0 +1,83 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// TXTResult is the answer to a TXT lookup
+type TXTResult struct {
+	// Records are the TXT records, each reassembled from its character-strings with joinTXT
+	Records []string
+
+	// TTL is the lowest TTL in the answer, zero when the backend does not expose it.
+	// When there are no records, TTL is the negative caching TTL from the zone's SOA record.
+	TTL time.Duration
+
+	// Security is the DNSSEC status of the answer, SecurityUnknown when the backend does not expose it
+	Security SecurityStatus
+}
+
+// SecurityStatus is the DNSSEC status of an answer, see RFC 4035 section 4.3
+type SecurityStatus int
+
+const (
+	// SecurityUnknown is the status when the lookup backend does not report one
+	SecurityUnknown SecurityStatus = iota
+
+	// SecurityInsecure answers were not validated, e.g. because the zone is not signed
+	SecurityInsecure
+
+	// SecuritySecure answers were validated by a trusted validating upstream, which set the AD bit
+	SecuritySecure
+
+	// SecurityBogus answers failed validation
+	SecurityBogus
+)
+
+func (s SecurityStatus) String() string {
+	return []string{"unknown", "insecure", "secure", "bogus"}[s]
+}
+
+// TXTLookuper is the backend used to look up TXT records.
+// A missing name or a name without TXT records is reported as a result without records;
+// a *net.DNSError with IsNotFound set, as net.Resolver.LookupTXT returns, is treated the same way.
+// Answers that failed DNSSEC validation are reported with an error matching ErrBogus.
+type TXTLookuper interface {
+	LookupTXT(ctx context.Context, name string) (TXTResult, error)
+}
+
+// SecurityReporter is implemented by lookup backends that may report the DNSSEC status of their answers
+type SecurityReporter interface {
+	// ReportsSecurity returns whether answers carry a DNSSEC status other than SecurityUnknown
+	ReportsSecurity() bool
+}
+
+// joinTXT reassembles a TXT record from its character-strings. A character-string holds
+// at most 255 bytes, so longer records, e.g. with a long destination URL, are published
+// split across several and are joined without a separator, as for SPF (RFC 7208 section 3.3)
+func joinTXT(strs []string) string {
+	return strings.Join(strs, "")
+}
+
+// SystemLookuper adapts a net.Resolver to TXTLookuper.
+// The system resolver does not expose TTLs, so results carry none.
+// net.Resolver.LookupTXT already joins each record's character-strings like joinTXT.
+type SystemLookuper struct {
+	Resolver *net.Resolver
+}
+
+func (s SystemLookuper) LookupTXT(ctx context.Context, name string) (TXTResult, error) {
+	records, err := s.Resolver.LookupTXT(ctx, name)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return TXTResult{}, nil
+		}
+
+		return TXTResult{}, err
+	}
+
+	return TXTResult{Records: records}, nil
+}
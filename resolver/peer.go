@@ -0,0 +1,324 @@
+package resolver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// peerReplicas is the number of points each peer has on the hash ring,
+	// more points spread hostnames more evenly
+	peerReplicas = 128
+
+	// peerErrorInvalid and friends tell a peer how a lookup failed
+	peerErrorInvalid  = "invalid"
+	peerErrorMultiple = "multiple"
+	peerErrorBogus    = "bogus"
+	peerErrorInsecure = "insecure"
+	peerErrorLoop     = "loop"
+	peerErrorTimeout  = "timeout"
+	peerErrorLookup   = "lookup"
+)
+
+var defaultPeerTimeout = time.Second * 2
+
+// peerRequestKey marks a request made by a peer, it is always resolved locally
+type peerRequestKey struct{}
+
+// peerResponse is the answer to a peer's resolve request
+type peerResponse struct {
+	Record RR `json:"record"`
+
+	// TTL is how much longer the owner has the record cached
+	TTL time.Duration `json:"ttl"`
+
+	Error     string `json:"error,omitempty"`
+	ErrorKind string `json:"errorKind,omitempty"`
+}
+
+// remoteError is an error reported by a peer, it matches kind with errors.Is
+type remoteError struct {
+	msg  string
+	kind error
+}
+
+func (e remoteError) Error() string {
+	return e.msg
+}
+
+func (e remoteError) Unwrap() error {
+	return e.kind
+}
+
+// peers shares resolved records between replicas. Each hostname is owned by one
+// peer picked by consistent hashing, the other peers ask the owner instead of DNS
+type peers struct {
+	self   string
+	all    []string
+	ring   *peerRing
+	client *http.Client
+	logger *slog.Logger
+}
+
+func newPeers(cfg ResolverConfig) (*peers, error) {
+	self := normalizePeer(cfg.PeerSelf)
+	all := make([]string, 0, len(cfg.Peers))
+
+	for _, peer := range cfg.Peers {
+		peer = normalizePeer(peer)
+
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid peer %q", peer)
+		}
+
+		all = append(all, peer)
+	}
+
+	if !slices.Contains(all, self) {
+		return nil, fmt.Errorf("peer self %q is not in the peer list", cfg.PeerSelf)
+	}
+
+	timeout := cfg.PeerTimeout
+	if timeout <= 0 {
+		timeout = defaultPeerTimeout
+	}
+
+	return &peers{
+		self:   self,
+		all:    all,
+		ring:   newPeerRing(all),
+		client: &http.Client{Timeout: timeout},
+		logger: cfg.Logger,
+	}, nil
+}
+
+func normalizePeer(peer string) string {
+	return strings.TrimRight(strings.TrimSpace(peer), "/")
+}
+
+// owner returns the peer that looks up hostname, and whether that is this replica
+func (p *peers) owner(hostname string) (string, bool) {
+	owner := p.ring.owner(hostname)
+	return owner, owner == p.self
+}
+
+// resolve asks peer for the record of hostname
+func (p *peers) resolve(ctx context.Context, peer, hostname string) (peerResponse, error) {
+	var resp peerResponse
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+"/peer/resolve?hostname="+url.QueryEscape(hostname), nil)
+	if err != nil {
+		return resp, err
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return resp, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("peer returned %s", res.Status)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return resp, fmt.Errorf("failed to decode peer response: %w", err)
+	}
+
+	return resp, nil
+}
+
+// invalidate tells every other peer to drop hostname, it does not wait for them
+func (p *peers) invalidate(hostname string) {
+	for _, peer := range p.all {
+		if peer == p.self {
+			continue
+		}
+
+		go func() {
+			req, err := http.NewRequest(http.MethodPost, peer+"/peer/invalidate?hostname="+url.QueryEscape(hostname), nil)
+			if err != nil {
+				return
+			}
+
+			res, err := p.client.Do(req)
+			if err != nil {
+				p.logger.Warn("failed to invalidate on peer", "peer", peer, "hostname", hostname, "error", err)
+				return
+			}
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusNoContent {
+				p.logger.Warn("failed to invalidate on peer", "peer", peer, "hostname", hostname, "status", res.StatusCode)
+			}
+		}()
+	}
+}
+
+// lookup resolves hostname through its owner peer, falling back to DNS
+// when this replica is the owner or the owner can't be reached.
+// A record from the owner comes with its remaining TTL, which the owner
+// already bounded when it cached the record, so every replica expires it together
+func (r *Resolver) lookup(ctx context.Context, l *slog.Logger, hostname string) (RR, time.Duration, error) {
+	if r.peers == nil || ctx.Value(peerRequestKey{}) != nil {
+		return r.doResolve(ctx, l, hostname)
+	}
+
+	owner, self := r.peers.owner(hostname)
+	if self {
+		return r.doResolve(ctx, l, hostname)
+	}
+
+	resp, err := r.peers.resolve(ctx, owner, hostname)
+	if err != nil {
+		l.Warn("failed to resolve on peer, resolving locally", "peer", owner, "error", err)
+		return r.doResolve(ctx, l, hostname)
+	}
+
+	l.Debug("resolved on peer", "peer", owner)
+
+	switch resp.ErrorKind {
+	case "":
+	case peerErrorInvalid:
+		return resp.Record, 0, &InvalidRecordError{Err: remoteError{msg: resp.Error}}
+	case peerErrorMultiple:
+		return resp.Record, 0, &InvalidRecordError{Err: remoteError{msg: resp.Error, kind: ErrMultipleRecords}}
+	case peerErrorBogus:
+		return resp.Record, 0, &InvalidRecordError{Err: remoteError{msg: resp.Error, kind: ErrBogus}}
+	case peerErrorInsecure:
+		return resp.Record, 0, &InvalidRecordError{Err: remoteError{msg: resp.Error, kind: ErrInsecure}}
+	case peerErrorLoop:
+		return resp.Record, 0, ErrLoop
+	case peerErrorTimeout:
+		return resp.Record, 0, fmt.Errorf("%w: peer %s failed to resolve %s: %s", ErrTimeout, owner, hostname, resp.Error)
+	default:
+		return resp.Record, 0, fmt.Errorf("%w: peer %s failed to resolve %s: %s", ErrDNSFailure, owner, hostname, resp.Error)
+	}
+
+	// the owner's stale answer is only good until its next attempt
+	if resp.Record.Stale {
+		return resp.Record, min(resp.TTL, staleAnswerTTL), nil
+	}
+
+	return resp.Record, resp.TTL, nil
+}
+
+// PeerHandler serves the peer protocol, it must only be reachable by other replicas
+func (r *Resolver) PeerHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /peer/resolve", r.handlePeerResolve)
+	mux.HandleFunc("POST /peer/invalidate", r.handlePeerInvalidate)
+
+	return mux
+}
+
+func (r *Resolver) handlePeerResolve(w http.ResponseWriter, req *http.Request) {
+	hostname := req.URL.Query().Get("hostname")
+	if hostname == "" {
+		http.Error(w, "hostname is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.WithValue(req.Context(), peerRequestKey{}, true)
+	record, err := r.Resolve(ctx, hostname)
+
+	resp := peerResponse{Record: record}
+
+	var invalid *InvalidRecordError
+
+	switch {
+	case err == nil, errors.Is(err, ErrNoRecord):
+	case errors.As(err, &invalid):
+		switch {
+		case errors.Is(err, ErrMultipleRecords):
+			resp.ErrorKind = peerErrorMultiple
+		case errors.Is(err, ErrBogus):
+			resp.ErrorKind = peerErrorBogus
+		case errors.Is(err, ErrInsecure):
+			resp.ErrorKind = peerErrorInsecure
+		default:
+			resp.ErrorKind = peerErrorInvalid
+		}
+
+		resp.Error = invalid.Err.Error()
+	case errors.Is(err, ErrLoop):
+		resp.ErrorKind = peerErrorLoop
+	case errors.Is(err, ErrTimeout):
+		resp.ErrorKind = peerErrorTimeout
+		resp.Error = err.Error()
+	default:
+		resp.ErrorKind = peerErrorLookup
+		resp.Error = err.Error()
+	}
+
+	hostname, _ = NormalizeHostname(hostname)
+	if _, expiration, ok := r.cache.GetStale(hostname); ok {
+		resp.TTL = max(0, r.cfg.Clock.Until(expiration))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (r *Resolver) handlePeerInvalidate(w http.ResponseWriter, req *http.Request) {
+	hostname := req.URL.Query().Get("hostname")
+	if hostname == "" {
+		http.Error(w, "hostname is required", http.StatusBadRequest)
+		return
+	}
+
+	r.invalidate(hostname)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// peerRing is a consistent hash ring, adding or removing a peer
+// only moves the hostnames that peer owns
+type peerRing struct {
+	hashes []uint64
+	owners map[uint64]string
+}
+
+func newPeerRing(peers []string) *peerRing {
+	ring := &peerRing{owners: make(map[uint64]string, len(peers)*peerReplicas)}
+
+	for _, peer := range peers {
+		for i := 0; i < peerReplicas; i++ {
+			h := hashKey(peer + "#" + strconv.Itoa(i))
+			ring.hashes = append(ring.hashes, h)
+			ring.owners[h] = peer
+		}
+	}
+
+	slices.Sort(ring.hashes)
+	return ring
+}
+
+// owner returns the first peer clockwise from hostname on the ring
+func (ring *peerRing) owner(hostname string) string {
+	h := hashKey(hostname)
+
+	i, _ := slices.BinarySearch(ring.hashes, h)
+	if i == len(ring.hashes) {
+		i = 0
+	}
+
+	return ring.owners[ring.hashes[i]]
+}
+
+// hashKey must be the same on every replica, so no seeded hashes
+func hashKey(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
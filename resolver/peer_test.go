@@ -0,0 +1,283 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/twopow/srd/internal/clock"
+)
+
+// newTestPeers starts n replicas sharing records through their peer servers
+func newTestPeers(t *testing.T, n int, lookuper TXTLookuper, opts ...func(cfg *ResolverConfig)) ([]*Resolver, []*httptest.Server) {
+	t.Helper()
+
+	servers := make([]*httptest.Server, n)
+	urls := make([]string, n)
+
+	// listen first so every replica knows the full peer list
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		urls[i] = "http://" + servers[i].Listener.Addr().String()
+		t.Cleanup(servers[i].Close)
+	}
+
+	resolvers := make([]*Resolver, n)
+	for i := range resolvers {
+		resolvers[i] = newTestResolver(t, lookuper, func(cfg *ResolverConfig) {
+			cfg.Peers = urls
+			cfg.PeerSelf = urls[i]
+			cfg.PeerTimeout = time.Second
+
+			for _, opt := range opts {
+				opt(cfg)
+			}
+		})
+
+		servers[i].Config.Handler = resolvers[i].PeerHandler()
+		servers[i].Start()
+	}
+
+	return resolvers, servers
+}
+
+func TestPeers_SharesLookups(t *testing.T) {
+	lookuper := &fakeLookuper{
+		records: map[string][]string{"_srd.example.com": {"v=srd1; dest=https://example.net; code=301"}},
+		ttl:     time.Minute * 5,
+	}
+
+	resolvers, _ := newTestPeers(t, 3, lookuper)
+
+	for _, r := range resolvers {
+		rr, err := r.Resolve(context.Background(), "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rr.To != "https://example.net" || rr.Code != 301 {
+			t.Errorf("Resolve() = %v, want shared record", rr)
+		}
+	}
+
+	if calls := lookuper.calls.Load(); calls != 1 {
+		t.Errorf("lookuper calls = %d, want 1 by the owner", calls)
+	}
+
+	// replicas cache the record for the owner's remaining ttl
+	for _, r := range resolvers {
+		if _, expiration, ok := r.cache.GetStale("example.com"); !ok || r.cfg.Clock.Until(expiration) > time.Minute*5 {
+			t.Errorf("cached expiration = %v, %v, want within the owner's ttl", expiration, ok)
+		}
+	}
+}
+
+func TestPeers_RemainingTTLNotClamped(t *testing.T) {
+	lookuper := &fakeLookuper{
+		records: map[string][]string{"_srd.example.com": {"v=srd1; dest=https://example.net"}},
+		ttl:     time.Minute,
+	}
+
+	resolvers, _ := newTestPeers(t, 2, lookuper, func(cfg *ResolverConfig) {
+		cfg.MinTTL = time.Minute * 2
+	})
+
+	owner, other := resolvers[0], resolvers[1]
+	if _, self := owner.peers.owner("example.com"); !self {
+		owner, other = other, owner
+	}
+
+	if _, err := owner.Resolve(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the owner raised the ttl to MinTTL once, 30s of it are left
+	owner.cfg.Clock.(*clock.Fake).Advance(time.Second * 90)
+
+	if _, err := other.Resolve(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, expiration, ok := other.cache.GetStale("example.com"); !ok || other.cfg.Clock.Until(expiration) > time.Second*30 {
+		t.Errorf("cached for %v, want the owner's remaining 30s", other.cfg.Clock.Until(expiration))
+	}
+}
+
+func TestPeers_SharesErrors(t *testing.T) {
+	lookuper := &fakeLookuper{
+		records: map[string][]string{
+			"_srd.invalid.example.com":  {"v=srd1; code=301"},
+			"_srd.multiple.example.com": {"v=srd1; dest=https://example.net", "v=srd1; dest=https://example.org"},
+		},
+		errs: map[string]error{
+			"_srd.bogus.example.com": fmt.Errorf("%w: DNSSEC bogus", ErrBogus),
+		},
+	}
+
+	resolvers, _ := newTestPeers(t, 3, lookuper)
+
+	for _, r := range resolvers {
+		if rr, err := r.Resolve(context.Background(), "missing.example.com"); !errors.Is(err, ErrNoRecord) || !rr.NotFound {
+			t.Errorf("Resolve() = %v, %v, want not found", rr, err)
+		}
+
+		_, err := r.Resolve(context.Background(), "invalid.example.com")
+
+		var invalid *InvalidRecordError
+		if !errors.As(err, &invalid) || invalid.Err.Error() != "no destination found" {
+			t.Errorf("Resolve() error = %v, want invalid record with its reason", err)
+		}
+
+		if _, err := r.Resolve(context.Background(), "multiple.example.com"); !errors.Is(err, ErrMultipleRecords) {
+			t.Errorf("Resolve() error = %v, want %v", err, ErrMultipleRecords)
+		}
+
+		if rr, err := r.Resolve(context.Background(), "bogus.example.com"); !errors.Is(err, ErrBogus) || rr.Security != SecurityBogus {
+			t.Errorf("Resolve() = %v, %v, want %v", rr, err, ErrBogus)
+		}
+	}
+
+	if calls := lookuper.calls.Load(); calls != 4 {
+		t.Errorf("lookuper calls = %d, want 4 by the owners", calls)
+	}
+}
+
+func TestPeers_Invalidate(t *testing.T) {
+	lookuper := &fakeLookuper{
+		records: map[string][]string{"_srd.example.com": {"v=srd1; dest=https://example.net"}},
+		ttl:     time.Minute * 5,
+	}
+
+	resolvers, _ := newTestPeers(t, 3, lookuper)
+
+	for _, r := range resolvers {
+		if _, err := r.Resolve(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resolvers[0].Invalidate("example.com")
+
+	// invalidations reach the other peers in the background
+	deadline := time.Now().Add(time.Second)
+	for _, r := range resolvers {
+		for r.cache.Len() > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		if n := r.cache.Len(); n != 0 {
+			t.Errorf("cache entries = %d after invalidate, want 0", n)
+		}
+	}
+}
+
+func TestPeers_OwnerDown(t *testing.T) {
+	lookuper := &fakeLookuper{
+		records: map[string][]string{},
+		ttl:     time.Minute * 5,
+	}
+
+	resolvers, servers := newTestPeers(t, 2, lookuper)
+
+	// find a hostname owned by the second replica and take it down
+	var hostname string
+	for i := 0; hostname == ""; i++ {
+		h := fmt.Sprintf("host-%d.example.com", i)
+		if _, self := resolvers[1].peers.owner(h); self {
+			hostname = h
+		}
+	}
+
+	lookuper.records["_srd."+hostname] = []string{"v=srd1; dest=https://example.net"}
+	servers[1].Close()
+
+	rr, err := resolvers[0].Resolve(context.Background(), hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.To != "https://example.net" {
+		t.Errorf("Resolve() = %v, want record resolved locally", rr)
+	}
+}
+
+func TestPeers_OwnerLookupFails(t *testing.T) {
+	lookuper := &fakeLookuper{err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}}
+
+	resolvers, _ := newTestPeers(t, 2, lookuper)
+
+	for _, r := range resolvers {
+		if _, err := r.Resolve(context.Background(), "example.com"); err == nil {
+			t.Error("Resolve() error = nil, want lookup failure")
+		}
+	}
+
+	// the replica that is not the owner does not retry the failed lookup itself
+	if calls := lookuper.calls.Load(); calls != 2 {
+		t.Errorf("lookuper calls = %d, want 2 by the owner", calls)
+	}
+}
+
+func TestPeers_Config(t *testing.T) {
+	tests := []struct {
+		name  string
+		peers []string
+		self  string
+	}{
+		{name: "self not in peers", peers: []string{"http://10.0.0.1:8082", "http://10.0.0.2:8082"}, self: "http://10.0.0.3:8082"},
+		{name: "missing scheme", peers: []string{"10.0.0.1:8082"}, self: "10.0.0.1:8082"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newPeers(ResolverConfig{Peers: tt.peers, PeerSelf: tt.self})
+			if err == nil {
+				t.Error("newPeers() error = nil, want config error")
+			}
+		})
+	}
+}
+
+func TestPeerRing(t *testing.T) {
+	peers := []string{"http://a:8082", "http://b:8082", "http://c:8082"}
+	ring := newPeerRing(peers)
+
+	counts := map[string]int{}
+	owners := map[string]string{}
+
+	for i := 0; i < 3000; i++ {
+		h := fmt.Sprintf("host-%d.example.com", i)
+		owners[h] = ring.owner(h)
+		counts[owners[h]]++
+	}
+
+	for _, peer := range peers {
+		if counts[peer] < 500 {
+			t.Errorf("peer %s owns %d of 3000 hostnames, want an even spread", peer, counts[peer])
+		}
+	}
+
+	// removing a peer only moves the hostnames it owned
+	smaller := newPeerRing(peers[:2])
+	for h, owner := range owners {
+		if owner != peers[2] && smaller.owner(h) != owner {
+			t.Fatalf("hostname %s moved from %s to %s", h, owner, smaller.owner(h))
+		}
+	}
+}
+
+func TestPeerHandler_BadRequest(t *testing.T) {
+	r := newTestResolver(t, &fakeLookuper{})
+
+	rec := httptest.NewRecorder()
+	r.PeerHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/peer/resolve", nil))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
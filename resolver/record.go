@@ -0,0 +1,237 @@
+package resolver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// recordField is a key and its value from a record, Column is where the key starts
+type recordField struct {
+	Key    string
+	Value  string
+	Column int
+}
+
+// RecordWarning is a problem in a record that does not stop it from being used.
+// Column is the 1-based position in the record it refers to
+type RecordWarning struct {
+	Column  int
+	Message string
+}
+
+func (w RecordWarning) String() string {
+	return fmt.Sprintf("column %d: %s", w.Column, w.Message)
+}
+
+// RecordSyntaxError is returned for a record that can't be tokenized.
+// Column is the 1-based position in the record of the problem
+type RecordSyntaxError struct {
+	Column  int
+	Message string
+}
+
+func (e *RecordSyntaxError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Column, e.Message)
+}
+
+// RecordFieldError is returned in strict mode for a field with an invalid value.
+// Column is the 1-based position in the record of the field
+type RecordFieldError struct {
+	Column  int
+	Message string
+}
+
+func (e *RecordFieldError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Column, e.Message)
+}
+
+// Record returns the canonical srd TXT record for rr, the inverse of parseRecord.
+// Keys are written in a fixed order and fields left at their defaults are omitted.
+// Only the fields of the record itself are kept, e.g. Hostname and Stale are not
+func (rr RR) Record() string {
+	version := rr.Version
+	if version == "" {
+		version = VERSION
+	}
+
+	fields := []string{"v=" + formatValue(version), "dest=" + formatValue(rr.To)}
+
+	if rr.Code != http.StatusFound {
+		fields = append(fields, "code="+strconv.Itoa(rr.Code))
+	}
+
+	if rr.PreserveRoute {
+		fields = append(fields, "route=preserve")
+	}
+
+	if rr.RefererPolicy != DefaultRefererPolicy {
+		fields = append(fields, "referer="+rr.RefererPolicy.String())
+	}
+
+	return strings.Join(fields, "; ")
+}
+
+// formatValue writes value bare when it reads back unchanged, and quoted otherwise
+func formatValue(value string) string {
+	bare := value != "" &&
+		!strings.ContainsAny(value, ";\"") &&
+		!isRecordSpace(value[0]) && !isRecordSpace(value[len(value)-1])
+
+	if bare {
+		return value
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+
+	for i := 0; i < len(value); i++ {
+		if value[i] == '"' || value[i] == '\\' {
+			b.WriteByte('\\')
+		}
+
+		b.WriteByte(value[i])
+	}
+
+	b.WriteByte('"')
+
+	return b.String()
+}
+
+// tokenizeRecord splits a record into its fields following the grammar in rfc.md section 3.4.
+// Values are either bare, running up to the next ";" with surrounding whitespace removed
+// and kept byte for byte, or quoted, where ";" needs no escaping and
+// a backslash escapes the next character. On a syntax error the fields before it are returned
+func tokenizeRecord(record string) ([]recordField, []RecordWarning, error) {
+	var fields []recordField
+	var warnings []RecordWarning
+
+	// records copied from zone files keep their surrounding quotes
+	offset := 1
+	if strings.HasPrefix(record, "\"") {
+		record = strings.TrimSuffix(record[1:], "\"")
+		offset++
+	}
+
+	i := 0
+	for i < len(record) {
+		// skip whitespace and empty fields
+		if record[i] == ';' || isRecordSpace(record[i]) {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(record) && record[i] != '=' && record[i] != ';' {
+			i++
+		}
+
+		field := recordField{
+			Key:    strings.TrimSpace(record[start:i]),
+			Column: offset + start,
+		}
+
+		if field.Key != "" && !isRecordKey(field.Key) {
+			return fields, warnings, &RecordSyntaxError{
+				Column:  field.Column,
+				Message: fmt.Sprintf("invalid key %q", field.Key),
+			}
+		}
+
+		// a key without a value, e.g. "route;"
+		if i == len(record) || record[i] == ';' {
+			fields = append(fields, field)
+			continue
+		}
+
+		// skip the "=" and whitespace up to the value
+		i++
+		for i < len(record) && isRecordSpace(record[i]) {
+			i++
+		}
+
+		if i < len(record) && record[i] == '"' {
+			value, n, err := scanQuoted(record[i:], offset+i)
+			if err != nil {
+				return fields, warnings, err
+			}
+
+			field.Value = value
+			i += n
+
+			for i < len(record) && isRecordSpace(record[i]) {
+				i++
+			}
+
+			if i < len(record) && record[i] != ';' {
+				return fields, warnings, &RecordSyntaxError{
+					Column:  offset + i,
+					Message: fmt.Sprintf("unexpected %q after quoted value, expected \";\"", record[i]),
+				}
+			}
+		} else {
+			vstart := i
+			for i < len(record) && record[i] != ';' {
+				i++
+			}
+
+			field.Value = strings.TrimRight(record[vstart:i], " \t")
+		}
+
+		if field.Key == "" {
+			warnings = append(warnings, RecordWarning{Column: field.Column, Message: "value without a key is ignored"})
+			continue
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields, warnings, nil
+}
+
+// scanQuoted reads a quoted value from the start of s, returning
+// the value and the number of bytes read including the quotes
+func scanQuoted(s string, column int) (string, int, error) {
+	var b strings.Builder
+
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\\':
+			if i+1 == len(s) {
+				return "", 0, &RecordSyntaxError{Column: column + i, Message: "backslash at end of record"}
+			}
+
+			i++
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return "", 0, &RecordSyntaxError{Column: column, Message: "unterminated quoted value"}
+}
+
+// isRecordKey reports whether key is a letter followed by letters, digits, "-" or "_"
+func isRecordKey(key string) bool {
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		isAlpha := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+
+		if i == 0 && !isAlpha {
+			return false
+		}
+
+		if !isAlpha && !(c >= '0' && c <= '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+
+	return key != ""
+}
+
+func isRecordSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
@@ -8,21 +8,40 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
-	"github.com/twopow/srd/internal/util"
+	"golang.org/x/net/idna"
+	"golang.org/x/sync/singleflight"
 
 	cache "github.com/twopow/srd/internal/cache"
+	"github.com/twopow/srd/internal/clock"
+	"github.com/twopow/srd/internal/util"
 )
 
 const (
 	// VERSION is the version of the SRD record format
 	VERSION = "srd1"
+
+	// staleAnswerTTL is how long a stale record is served before
+	// another lookup is attempted, as recommended by RFC 8767
+	staleAnswerTTL = time.Second * 30
+
+	// prefetchWindow is the fraction of a record's TTL left
+	// at which a frequently used record is prefetched
+	prefetchWindow = 0.1
 )
 
 var defaultNoHostBaseRedirect = "https://srd.sh"
 var defaultToolboxHost = "https://srd.sh"
+var defaultNegativeTTL = time.Second * 60
+var defaultLookupTimeout = time.Second * 5
+var defaultPrefetchConcurrency = 4
+var defaultAllowedSchemes = []string{"http", "https"}
 
 type ResolverContextKey string
 
@@ -44,26 +63,149 @@ type ResolverConfig struct {
 	// resolving a request and we fail to find a record
 	NoHostBaseRedirect string
 
-	// TTL is the cache TTL
+	// StrictRecords makes records with invalid field values, e.g. code=310, invalid.
+	// by default the field's default is used instead and a warning logged
+	StrictRecords bool
+
+	// InspectorLenient validates records in the inspector like redirects are without StrictRecords,
+	// by default the inspector is strict so zone owners see every mistake
+	InspectorLenient bool
+
+	// RequireSecure refuses records that aren't DNSSEC secure, New fails without a lookup backend
+	// that reports the status, see SecurityReporter, e.g. a DNSClient with TrustAD. Bogus answers are always refused
+	RequireSecure bool
+
+	// AllowedSchemes are the destination URL schemes records may redirect to,
+	// records with other schemes are invalid. defaults to http and https
+	AllowedSchemes []string
+
+	// TTL is the cache TTL used when the lookup backend does not report one
 	TTL time.Duration
 
+	// MinTTL is the lower bound for the TTL of cached records, zero means no bound
+	MinTTL time.Duration
+
+	// MaxTTL is the upper bound for the TTL of cached records, zero means no bound
+	MaxTTL time.Duration
+
+	// NegativeTTL is the cache TTL for missing and invalid records.
+	// the zone's SOA negative TTL is used instead when it is lower
+	NegativeTTL time.Duration
+
+	// LookupTimeout bounds a lookup shared by concurrent callers,
+	// each caller still gives up on its own context
+	LookupTimeout time.Duration
+
+	// StaleWindow is how long past expiry a record is kept and served
+	// when fresh lookups fail (RFC 8767), zero disables serving stale records
+	StaleWindow time.Duration
+
+	// PrefetchHits is how many times a cached record must be used before it is
+	// re-resolved in the background when close to expiring, zero disables prefetching
+	PrefetchHits int
+
+	// PrefetchConcurrency is the maximum number of prefetches in flight
+	PrefetchConcurrency int
+
 	// CleanupInterval is how often to cleanup the cache
 	CleanupInterval time.Duration
 
+	// CacheMaxEntries is the maximum number of cached hostnames, zero means unbounded
+	CacheMaxEntries int
+
+	// CacheMaxBytes is the approximate maximum size of the cache, zero means unbounded
+	CacheMaxBytes int64
+
+	// SlidingExpiry extends a cached record's expiry each time it is used.
+	// by default records expire their TTL after they were resolved,
+	// so changes to a record are picked up even under steady traffic
+	SlidingExpiry bool
+
+	// SnapshotPath is the file the cache is saved to on Close and loaded from by New,
+	// so a restarted resolver starts warm. if this is empty, snapshots are disabled
+	SnapshotPath string
+
+	// SnapshotInterval is how often the cache is also saved while running, zero saves only on Close
+	SnapshotInterval time.Duration
+
+	// Peers are the base URLs of all replicas sharing resolved records, including this one,
+	// e.g. "http://10.0.0.2:8082". if this is empty, peer mode is disabled
+	Peers []string
+
+	// PeerSelf is this replica's URL as it appears in Peers
+	PeerSelf string
+
+	// PeerTimeout bounds requests to other peers
+	PeerTimeout time.Duration
+
+	// Clock is used for cache expiry and timing, defaults to clock.Real
+	Clock clock.Clock
+
+	// Lookuper is the backend used for TXT lookups
+	// if this is nil, net.DefaultResolver is used
+	Lookuper TXTLookuper
+
 	// Logger is the logger to use
 	Logger *slog.Logger
 }
 
 type ResolverProvider interface {
 	Resolve(ctx context.Context, hostname string) (RR, error)
+	Inspect(ctx context.Context, hostname string) (Inspection, error)
+	Invalidate(hostname string)
+	Upstreams() []UpstreamHealth
+	Close() error
+	PeerHandler() http.Handler
 	Config() *ResolverConfig
 	Logger() *slog.Logger
 }
 
 type Resolver struct {
 	logger *slog.Logger
-	cache  cache.CacheProvider
+	cache  cache.Provider[string, entry]
 	cfg    ResolverConfig
+
+	// lookups coalesces concurrent resolutions of the same hostname
+	lookups singleflight.Group
+
+	// prefetch bounds the prefetches in flight, prefetching holds their hostnames
+	prefetch    chan struct{}
+	prefetching sync.Map
+
+	// peers is set in peer mode
+	peers *peers
+
+	// done stops the snapshot goroutine
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// entry is the value the resolver keeps in the cache
+type entry struct {
+	record RR
+
+	// err is set when the record failed to parse, so a cached
+	// invalid record fails the same way as a fresh lookup
+	err error
+
+	// staleUntil is when a record being served stale stops being served
+	staleUntil time.Time
+
+	// expires and ttl are when and for how long the record was cached,
+	// hits counts its uses since; they drive prefetching
+	expires time.Time
+	ttl     time.Duration
+	hits    *atomic.Int64
+}
+
+// Size approximates the memory used by the entry for the cache byte budget
+func (e entry) Size() int {
+	size := len(e.record.Hostname) + len(e.record.To) + len(e.record.Version) + 128
+	if e.err != nil {
+		size += len(e.err.Error())
+	}
+
+	return size
 }
 
 // RR is a Redirect Record
@@ -75,12 +217,67 @@ type RR struct {
 	Code          int
 	NotFound      bool
 	Version       string
+
+	// Security is the DNSSEC status of the answer the record was found in
+	Security SecurityStatus
+
+	// Stale is set when the record is served past its TTL because lookups are failing
+	Stale bool
+}
+
+// Inspection is a host's record as the inspector reports it
+type Inspection struct {
+	RR
+
+	// Warnings are the problems with the record that don't make it invalid
+	Warnings []RecordWarning
 }
 
 var RRNotFound = RR{NotFound: true, RefererPolicy: RefererPolicyNone, Code: http.StatusNotFound}
 var ErrLoop = errors.New("loop detected")
 var ErrHostIsIp = errors.New("host is ip")
 
+// ErrInvalidHostname is returned for a hostname that isn't a valid DNS name, see NormalizeHostname
+var ErrInvalidHostname = errors.New("invalid hostname")
+
+// ErrNoRecord is returned, with RR.NotFound set, when the host has no srd record
+var ErrNoRecord = errors.New("no srd record")
+
+// ErrInvalidRecord matches every InvalidRecordError
+var ErrInvalidRecord = errors.New("invalid srd record")
+
+// ErrMultipleRecords is the reason of the InvalidRecordError returned when a host has more than one srd record
+var ErrMultipleRecords = errors.New("multiple srd records")
+
+// ErrDNSFailure is returned when the record can't be looked up and no stale record is available
+var ErrDNSFailure = errors.New("dns resolution failed")
+
+// ErrBogus is returned, as the reason of an InvalidRecordError, when the answer failed DNSSEC validation
+var ErrBogus = errors.New("dnssec validation failed")
+
+// ErrInsecure is the reason of the InvalidRecordError returned with RequireSecure for a record that isn't DNSSEC secure
+var ErrInsecure = errors.New("record is not dnssec secure")
+
+// ErrTimeout is returned when the lookup does not finish in time and no stale record is available
+var ErrTimeout = errors.New("dns resolution timed out")
+
+// InvalidRecordError is returned for a record that is not a valid srd record, Err is the reason
+type InvalidRecordError struct {
+	Err error
+}
+
+func (e *InvalidRecordError) Error() string {
+	return ErrInvalidRecord.Error() + ": " + e.Err.Error()
+}
+
+func (e *InvalidRecordError) Unwrap() error {
+	return e.Err
+}
+
+func (e *InvalidRecordError) Is(target error) bool {
+	return target == ErrInvalidRecord
+}
+
 type RefererPolicy int
 
 const (
@@ -113,9 +310,53 @@ func New(cfg ResolverConfig) (ResolverProvider, error) {
 		cfg.ToolboxHost = defaultToolboxHost
 	}
 
-	c, err := cache.New(cache.CacheConfig{
+	if len(cfg.AllowedSchemes) == 0 {
+		cfg.AllowedSchemes = defaultAllowedSchemes
+	}
+
+	cfg.AllowedSchemes = slices.Clone(cfg.AllowedSchemes)
+	for i, scheme := range cfg.AllowedSchemes {
+		cfg.AllowedSchemes[i] = strings.ToLower(scheme)
+	}
+
+	if cfg.Lookuper == nil {
+		cfg.Lookuper = SystemLookuper{Resolver: net.DefaultResolver}
+	}
+
+	if cfg.RequireSecure {
+		if sr, ok := cfg.Lookuper.(SecurityReporter); !ok || !sr.ReportsSecurity() {
+			return nil, fmt.Errorf("require secure needs a lookup backend that reports dnssec status, e.g. a dns client with trust ad")
+		}
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real
+	}
+
+	if cfg.NegativeTTL <= 0 {
+		cfg.NegativeTTL = defaultNegativeTTL
+	}
+
+	if cfg.LookupTimeout <= 0 {
+		cfg.LookupTimeout = defaultLookupTimeout
+	}
+
+	if cfg.PrefetchConcurrency <= 0 {
+		cfg.PrefetchConcurrency = defaultPrefetchConcurrency
+	}
+
+	if cfg.MaxTTL > 0 && cfg.MinTTL > cfg.MaxTTL {
+		return nil, fmt.Errorf("min ttl %s is greater than max ttl %s", cfg.MinTTL, cfg.MaxTTL)
+	}
+
+	c, err := cache.NewCache[string, entry](cache.CacheConfig{
 		TTL:             cfg.TTL,
 		CleanupInterval: cfg.CleanupInterval,
+		StaleWindow:     cfg.StaleWindow,
+		Sliding:         cfg.SlidingExpiry,
+		MaxEntries:      cfg.CacheMaxEntries,
+		MaxBytes:        cfg.CacheMaxBytes,
+		Clock:           cfg.Clock,
 		Logger:          cfg.Logger,
 	})
 
@@ -123,49 +364,257 @@ func New(cfg ResolverConfig) (ResolverProvider, error) {
 		return nil, fmt.Errorf("failed to init resolver: %w", err)
 	}
 
-	return &Resolver{
-		cfg:    cfg,
-		cache:  c,
-		logger: cfg.Logger,
-	}, nil
+	r := &Resolver{
+		cfg:      cfg,
+		cache:    c,
+		logger:   cfg.Logger,
+		prefetch: make(chan struct{}, cfg.PrefetchConcurrency),
+		done:     make(chan struct{}),
+	}
+
+	if len(cfg.Peers) > 0 {
+		if r.peers, err = newPeers(cfg); err != nil {
+			return nil, fmt.Errorf("failed to init peers: %w", err)
+		}
+	}
+
+	if cfg.SnapshotPath != "" {
+		// a missing or unreadable snapshot only means a cold start
+		if err := r.loadSnapshot(cfg.SnapshotPath); err != nil {
+			cfg.Logger.Warn("failed to load cache snapshot", "path", cfg.SnapshotPath, "error", err)
+		}
+
+		if cfg.SnapshotInterval > 0 {
+			go r.snapshotTimer(cfg.Clock.NewTicker(cfg.SnapshotInterval))
+		}
+	}
+
+	return r, nil
 }
 
-func (r *Resolver) Resolve(ctx context.Context, hostname string) (record RR, err error) {
-	ctx = context.WithValue(ctx, ResolverContextKey("hostname"), hostname)
+// Resolve returns the redirect record for hostname. Missing records return ErrNoRecord
+// with RR.NotFound set, other failures return ErrInvalidRecord, ErrDNSFailure, ErrTimeout or ErrLoop
+func (r *Resolver) Resolve(ctx context.Context, hostname string) (RR, error) {
+	record, err := r.resolveHost(ctx, hostname)
+	if err == nil && record.NotFound {
+		return record, ErrNoRecord
+	}
 
-	stime := time.Now()
+	return record, err
+}
 
-	hostname = strings.ToLower(hostname)
-	hostname = strings.TrimSpace(hostname)
+// Inspect looks up the current record for hostname, bypassing the cache, and validates it
+// strictly unless InspectorLenient is set. When the lookup fails, the record Resolve
+// would serve is returned instead, e.g. a stale one, with Resolve's error
+func (r *Resolver) Inspect(ctx context.Context, hostname string) (Inspection, error) {
+	hostname, err := NormalizeHostname(hostname)
+	if err != nil {
+		return Inspection{}, err
+	}
+
+	l := r.logger.With("hostname", hostname, "inspect", true)
+
+	result, err := r.resolveTXT(ctx, hostname)
+	if err != nil {
+		l.Warn("inspect lookup failed", "error", err)
+
+		rr, err := r.Resolve(ctx, hostname)
+		return Inspection{RR: rr}, err
+	}
+
+	rr, warnings, err := r.parseTXT(l, hostname, result, !r.cfg.InspectorLenient)
+	inspection := Inspection{RR: rr, Warnings: warnings}
+
+	if err != nil {
+		return inspection, err
+	}
+
+	if rr.NotFound {
+		return inspection, ErrNoRecord
+	}
+
+	if err := r.detectLoop(l, hostname, rr.To); err != nil {
+		if errors.Is(err, ErrLoop) {
+			return inspection, ErrLoop
+		}
+
+		return inspection, fmt.Errorf("loop detection failed: %w", err)
+	}
+
+	return inspection, nil
+}
 
+func (r *Resolver) resolveHost(ctx context.Context, hostname string) (record RR, err error) {
+	ctx = context.WithValue(ctx, ResolverContextKey("hostname"), hostname)
+
+	stime := r.cfg.Clock.Now()
+
+	hostname, err = NormalizeHostname(hostname)
 	l := r.logger.With("hostname", hostname)
 
-	if util.IsIp(hostname) {
+	if errors.Is(err, ErrHostIsIp) {
 		l.Info("hostname is ip")
-		return RR{}, ErrHostIsIp
+		return RR{}, err
 	}
 
-	if cached, ok := r.getCached(l, hostname); ok {
+	if err != nil {
+		l.Info("invalid hostname", "error", err)
+		return RR{}, err
+	}
+
+	if cached, ok := r.getCached(hostname); ok {
+		if cached.err != nil || cached.record.NotFound {
+			l.Info("resolved host",
+				"cached", true,
+				"notFound", true,
+				"error", cached.err,
+				"elapsed", r.cfg.Clock.Since(stime).Milliseconds(),
+			)
+
+			return cached.record, cached.err
+		}
+
 		l.Info("resolved host",
-			"to", cached.To,
+			"to", cached.record.To,
 			"cached", true,
-			"elapsed", time.Since(stime).Milliseconds(),
-			"preserveRoute", cached.PreserveRoute,
-			"code", cached.Code,
-			"referrerPolicy", cached.RefererPolicy.String(),
+			"stale", cached.record.Stale,
+			"elapsed", r.cfg.Clock.Since(stime).Milliseconds(),
+			"preserveRoute", cached.record.PreserveRoute,
+			"code", cached.record.Code,
+			"referrerPolicy", cached.record.RefererPolicy.String(),
 		)
 
-		return cached, nil
+		r.maybePrefetch(l, hostname, cached)
+
+		return cached.record, nil
+	}
+
+	// a previous lookup already failed, answer stale right away and refresh off the request path
+	if stale, ok := r.getStale(hostname); ok && stale.record.Stale {
+		l.Warn("serving stale record", "to", stale.record.To, "elapsed", r.cfg.Clock.Since(stime).Milliseconds())
+		go r.refresh(l, hostname)
+
+		return stale.record, nil
+	}
+
+	return r.resolveShared(ctx, l, hostname, stime)
+}
+
+// refresh re-resolves hostname off the request path
+func (r *Resolver) refresh(l *slog.Logger, hostname string) {
+	if _, err := r.resolveShared(context.Background(), l, hostname, r.cfg.Clock.Now()); err != nil {
+		l.Warn("refresh failed", "error", err)
+	}
+}
+
+// maybePrefetch counts a use of a cached entry and re-resolves it in the background
+// when it is used often enough and close to expiring, so requests rarely wait on DNS
+func (r *Resolver) maybePrefetch(l *slog.Logger, hostname string, e entry) {
+	if r.cfg.PrefetchHits <= 0 || e.hits == nil || e.record.Stale {
+		return
+	}
+
+	hits := e.hits.Add(1)
+	if hits < int64(r.cfg.PrefetchHits) {
+		return
+	}
+
+	if r.cfg.Clock.Until(e.expires) > time.Duration(float64(e.ttl)*prefetchWindow) {
+		return
+	}
+
+	if _, inflight := r.prefetching.LoadOrStore(hostname, struct{}{}); inflight {
+		return
+	}
+
+	select {
+	case r.prefetch <- struct{}{}:
+	default:
+		r.prefetching.Delete(hostname)
+		l.Debug("prefetch skipped, too many in flight")
+		return
 	}
 
-	record, err = r.doResolve(ctx, l, hostname)
+	go func() {
+		defer func() {
+			<-r.prefetch
+			r.prefetching.Delete(hostname)
+		}()
+
+		l.Debug("prefetching", "hits", hits)
+		r.refresh(l, hostname)
+	}()
+}
+
+// resolveShared resolves hostname once for all concurrent callers and shares the result.
+// The lookup is detached from the caller that started it, so each caller only
+// gives up when its own context is done
+func (r *Resolver) resolveShared(ctx context.Context, l *slog.Logger, hostname string, stime time.Time) (RR, error) {
+	ch := r.lookups.DoChan(hostname, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.cfg.LookupTimeout)
+		defer cancel()
+
+		return r.resolve(ctx, l, hostname, stime)
+	})
+
+	select {
+	case res := <-ch:
+		if res.Shared {
+			l.Debug("shared lookup", "elapsed", r.cfg.Clock.Since(stime).Milliseconds())
+		}
+
+		// only lookup failures fall back to stale, a bad record or loop is a real answer
+		if res.Err != nil && !errors.Is(res.Err, ErrInvalidRecord) && !errors.Is(res.Err, ErrLoop) {
+			if stale, ok := r.getStale(hostname); ok {
+				l.Warn("serving stale record", "to", stale.record.To, "error", res.Err)
+				return stale.record, nil
+			}
+		}
+
+		return res.Val.(RR), res.Err
+	case <-ctx.Done():
+		// the lookup carries on in the background and caches its result
+		if stale, ok := r.getStale(hostname); ok {
+			l.Warn("serving stale record", "to", stale.record.To, "error", ctx.Err())
+			stale.record.Stale = true
+			return stale.record, nil
+		}
+
+		l.Warn("gave up waiting for lookup", "error", ctx.Err())
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return RR{}, fmt.Errorf("%w: failed to resolve %s: %w", ErrTimeout, hostname, ctx.Err())
+		}
+
+		return RR{}, fmt.Errorf("failed to resolve %s: %w", hostname, ctx.Err())
+	}
+}
+
+// resolve looks up hostname and caches the result
+func (r *Resolver) resolve(ctx context.Context, l *slog.Logger, hostname string, stime time.Time) (RR, error) {
+	record, ttl, err := r.lookup(ctx, l, hostname)
 	if err != nil {
+		if errors.Is(err, ErrInvalidRecord) {
+			r.cache.SetFixed(hostname, entry{record: record, err: err}, r.negativeTTL(0))
+		} else if !errors.Is(err, ErrLoop) {
+			r.markStale(hostname)
+		}
+
 		return record, err
 	}
 
+	if record.NotFound {
+		ttl = r.negativeTTL(ttl)
+		l.Info("resolved host", "notFound", true, "ttl", ttl.Seconds(), "elapsed", r.cfg.Clock.Since(stime).Milliseconds())
+		r.cache.SetFixed(hostname, entry{record: record}, ttl)
+
+		return record, nil
+	}
+
 	l = l.With(
 		"to", record.To,
-		"elapsed", time.Since(stime).Milliseconds(),
+		"ttl", ttl.Seconds(),
+		"elapsed", r.cfg.Clock.Since(stime).Milliseconds(),
 		"preserveRoute", record.PreserveRoute,
 		"refererPolicy", record.RefererPolicy.String(),
 		"code", record.Code,
@@ -183,68 +632,161 @@ func (r *Resolver) Resolve(ctx context.Context, hostname string) (record RR, err
 	}
 
 	l.Info("resolved host")
-	r.cache.Set(hostname, record)
+	r.cache.SetWithTTL(hostname, entry{
+		record:  record,
+		expires: r.cfg.Clock.Now().Add(ttl),
+		ttl:     ttl,
+		hits:    new(atomic.Int64),
+	}, ttl)
 
 	return record, nil
 }
 
-func (r *Resolver) doResolve(ctx context.Context, l *slog.Logger, hostname string) (record RR, err error) {
+// doResolve looks up and parses the record for hostname, returning it with the TTL to cache it for,
+// see cacheTTL, or for a missing record with the negative TTL reported by the lookup backend
+func (r *Resolver) doResolve(ctx context.Context, l *slog.Logger, hostname string) (record RR, ttl time.Duration, err error) {
 	record.NotFound = true
-	txtRecords, err := r.resolveTXT(ctx, hostname)
+	result, err := r.resolveTXT(ctx, hostname)
+
+	if errors.Is(err, ErrBogus) {
+		l.Error("dnssec validation failed", "error", err)
+
+		bogus := RRNotFound
+		bogus.Security = SecurityBogus
+		return bogus, 0, &InvalidRecordError{Err: err}
+	}
 
 	if err != nil {
 		l.Error("failed to resolve host", "error", err)
-		return record, err
+		return record, 0, err
 	}
 
-	if len(txtRecords) == 0 {
-		l.Info("no records found")
-		return record, nil
+	record, _, err = r.parseTXT(l, hostname, result, r.cfg.StrictRecords)
+	if err != nil {
+		return record, 0, err
+	}
+
+	if record.NotFound {
+		return record, result.TTL, nil
+	}
+
+	return record, r.cacheTTL(result.TTL), nil
+}
+
+// parseTXT picks the srd record out of hostname's TXT records and parses it,
+// see parseRecord for strict. Without an srd record, the returned record has NotFound set
+func (r *Resolver) parseTXT(l *slog.Logger, hostname string, result TXTResult, strict bool) (RR, []RecordWarning, error) {
+	records := srdRecords(result.Records)
+
+	switch len(records) {
+	case 0:
+		l.Info("no records found", "txtRecords", len(result.Records))
+		return RR{NotFound: true, Security: result.Security}, nil, nil
+	case 1:
+	default:
+		// picking one would depend on the order DNS returns them in
+		l.Error("multiple records found", "records", len(records))
+		return RRNotFound, nil, &InvalidRecordError{Err: fmt.Errorf("%w: found %d", ErrMultipleRecords, len(records))}
+	}
+
+	record, warnings, err := parseRecord(records[0], strict)
+	for _, w := range warnings {
+		l.Warn("record warning", "warning", w.String())
 	}
 
-	record, err = parseRecord(txtRecords[0])
 	if err != nil {
 		l.Error("failed to parse record", "error", err)
-		return record, err
+		return record, warnings, &InvalidRecordError{Err: err}
 	}
 
-	// url.Parse expects a scheme
-	if !strings.Contains(record.To, "://") {
-		record.To = "http://" + record.To
+	if scheme, _, _ := strings.Cut(record.To, "://"); !slices.Contains(r.cfg.AllowedSchemes, scheme) {
+		l.Error("destination scheme not allowed", "scheme", scheme)
+		return RRNotFound, warnings, &InvalidRecordError{Err: fmt.Errorf("destination scheme %q is not allowed", scheme)}
+	}
+
+	record.Security = result.Security
+
+	if r.cfg.RequireSecure && record.Security != SecuritySecure {
+		l.Error("record is not dnssec secure", "security", record.Security.String())
+
+		insecure := RRNotFound
+		insecure.Security = record.Security
+		return insecure, warnings, &InvalidRecordError{Err: fmt.Errorf("%w: status is %s", ErrInsecure, record.Security)}
 	}
 
 	record.Hostname = hostname
-	return record, nil
+	return record, warnings, nil
+}
+
+// cacheTTL returns how long a record should be cached given the TTL from DNS,
+// falling back to the configured TTL and clamped to the configured bounds
+func (r *Resolver) cacheTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = r.cfg.TTL
+	}
+
+	if r.cfg.MinTTL > 0 && ttl < r.cfg.MinTTL {
+		ttl = r.cfg.MinTTL
+	}
+
+	if r.cfg.MaxTTL > 0 && ttl > r.cfg.MaxTTL {
+		ttl = r.cfg.MaxTTL
+	}
+
+	return ttl
 }
 
-func parseRecord(record string) (RR, error) {
+// negativeTTL returns how long a missing or invalid record should be cached
+// given the negative TTL from the zone's SOA, capped by the configured NegativeTTL
+func (r *Resolver) negativeTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 || ttl > r.cfg.NegativeTTL {
+		return r.cfg.NegativeTTL
+	}
+
+	return ttl
+}
+
+// parseRecord parses an srd record, see tokenizeRecord for the syntax.
+// Unknown and repeated keys don't make the record invalid, they are reported as warnings
+// and the first occurrence of a key is used. Invalid field values, e.g. code=310, make
+// the record invalid when strict is set, otherwise the default is used and a warning reported
+func parseRecord(record string, strict bool) (RR, []RecordWarning, error) {
 	rr := RR{
 		NotFound:      false,
 		Code:          http.StatusFound,
 		RefererPolicy: DefaultRefererPolicy,
 	}
 
-	// remove bounding quotes if they exist
-	record = strings.Trim(record, "\"")
-	parts := strings.Split(record, ";")
+	fields, warnings, err := tokenizeRecord(record)
+	if err != nil {
+		return RRNotFound, warnings, err
+	}
+
+	seen := make(map[string]bool, len(fields))
 
-	for _, part := range parts {
-		part = strings.TrimSpace(part)
-		if part == "" {
+	for _, field := range fields {
+		key := field.Key
+		if key == "referrer" {
+			key = "referer"
+		}
+
+		switch key {
+		case "v", "dest", "code", "route", "referer":
+		default:
+			warnings = append(warnings, RecordWarning{Column: field.Column, Message: fmt.Sprintf("unknown key %q is ignored", field.Key)})
 			continue
 		}
 
-		segments := strings.SplitN(part, "=", 2)
-		if len(segments) == 0 {
-			continue // Skip malformed parts
+		if seen[key] {
+			warnings = append(warnings, RecordWarning{Column: field.Column, Message: fmt.Sprintf("duplicate key %q is ignored", field.Key)})
+			continue
 		}
 
-		key := strings.TrimSpace(segments[0])
-		value := ""
+		seen[key] = true
+		value := field.Value
 
-		if len(segments) > 1 {
-			value = strings.TrimSpace(segments[1])
-		}
+		// invalid is the problem with the value, if any, and fallback what is used instead
+		var invalid, fallback string
 
 		switch key {
 		case "v":
@@ -252,32 +794,116 @@ func parseRecord(record string) (RR, error) {
 		case "dest":
 			rr.To = value
 		case "code":
-			rr.Code = parseCode(value)
+			var ok bool
+			if rr.Code, ok = parseCode(value); !ok {
+				invalid, fallback = fmt.Sprintf("invalid code %q, allowed values are 301, 302, 307 and 308", value), "using 302"
+			}
 		case "route":
-			if value == "preserve" {
+			switch value {
+			case "preserve":
 				rr.PreserveRoute = true
+			default:
+				invalid, fallback = fmt.Sprintf("invalid route %q, the allowed value is preserve", value), "the route is not preserved"
+			}
+		case "referer":
+			var ok bool
+			if rr.RefererPolicy, ok = parseRefererPolicy(value); !ok {
+				invalid, fallback = fmt.Sprintf("invalid %s %q, allowed values are none, host and full", field.Key, value), "using "+DefaultRefererPolicy.String()
 			}
-		case "referer", "referrer":
-			rr.RefererPolicy = parseRefererPolicy(value)
 		}
+
+		if invalid == "" {
+			continue
+		}
+
+		if strict {
+			return RRNotFound, warnings, &RecordFieldError{Column: field.Column, Message: invalid}
+		}
+
+		warnings = append(warnings, RecordWarning{Column: field.Column, Message: invalid + ", " + fallback})
 	}
 
 	if rr.Version != VERSION {
-		return RRNotFound, fmt.Errorf("invalid version")
+		return RRNotFound, warnings, fmt.Errorf("invalid version")
 	}
 
 	if rr.To == "" {
-		return RRNotFound, fmt.Errorf("no destination found")
-	} else {
-		rr.To = strings.ToLower(rr.To)
-		rr.To = strings.TrimSpace(rr.To)
+		return RRNotFound, warnings, fmt.Errorf("no destination found")
+	}
+
+	if rr.To, err = normalizeDest(rr.To); err != nil {
+		return RRNotFound, warnings, err
+	}
+
+	return rr, warnings, nil
+}
+
+// normalizeDest lowercases the scheme and host of a destination URL, defaulting the scheme to http.
+// Internationalized hosts are converted to their ASCII form, so they can be used in the Location header.
+// The rest of the URL is kept byte-for-byte, paths and queries can be case-sensitive
+func normalizeDest(dest string) (string, error) {
+	dest = strings.TrimSpace(dest)
+
+	// url.Parse expects a scheme, "://" later in the URL, e.g. in the query, doesn't count
+	if i := strings.Index(dest, "://"); i < 0 || strings.ContainsAny(dest[:i], "/?#") {
+		dest = "http://" + dest
+	}
+
+	scheme, rest, _ := strings.Cut(dest, "://")
+	userinfo, host, after := splitHost(rest)
+
+	host = strings.ToLower(host)
+	if !isASCII(host) {
+		var err error
+		if host, err = idna.Lookup.ToASCII(host); err != nil {
+			return "", fmt.Errorf("invalid destination")
+		}
 	}
 
-	if _, err := url.Parse(rr.To); err != nil {
-		return RRNotFound, fmt.Errorf("invalid destination")
+	dest = strings.ToLower(scheme) + "://" + userinfo + host + after
+
+	u, err := url.Parse(dest)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid destination")
 	}
 
-	return rr, nil
+	return dest, nil
+}
+
+// splitHost splits the part of a URL after "scheme://" around its host,
+// e.g. "user@Example.com:8080/Path" into "user@", "Example.com" and ":8080/Path"
+func splitHost(rest string) (userinfo, host, after string) {
+	end := strings.IndexAny(rest, "/?#")
+	if end < 0 {
+		end = len(rest)
+	}
+
+	authority := rest[:end]
+	at := strings.LastIndex(authority, "@") + 1
+	host = util.StripPort(authority[at:])
+
+	return authority[:at], host, authority[at+len(host):] + rest[end:]
+}
+
+// UnicodeTo returns To with an internationalized host in its Unicode form, for display
+func (rr RR) UnicodeTo() string {
+	scheme, rest, ok := strings.Cut(rr.To, "://")
+	if !ok {
+		return rr.To
+	}
+
+	userinfo, host, after := splitHost(rest)
+	return scheme + "://" + userinfo + UnicodeHostname(host) + after
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
 }
 
 // detectLoop checks if the to host is already in the cache
@@ -288,85 +914,194 @@ func (r *Resolver) detectLoop(l *slog.Logger, hostname, to string) error {
 		return err
 	}
 
-	toHost := url.Host
+	// destinations on an ip or an invalid host have no record to loop through
+	toHost, err := NormalizeHostname(url.Host)
+	if err != nil {
+		return nil
+	}
 
 	if toHost == hostname {
 		return ErrLoop
 	}
 
-	rr, ok := r.getCached(l, toHost)
+	cached, ok := r.getCached(toHost)
 
 	// if the record does not exist or is not valid, we are not in a loop
-	if !ok || rr.NotFound {
+	if !ok || cached.err != nil || cached.record.NotFound {
 		return nil
 	}
 
 	return ErrLoop
 }
 
-// resolveTXT takes a hostname with prefix and returns its TXT records.
+// resolveTXT takes a hostname with prefix and returns its TXT records and their TTL.
 // Returns an error if the lookup fails
-func (r *Resolver) resolveTXT(ctx context.Context, hostname string) ([]string, error) {
+func (r *Resolver) resolveTXT(ctx context.Context, hostname string) (TXTResult, error) {
 	hostname = fmt.Sprintf("%s.%s", r.cfg.RecordPrefix, hostname)
 
-	records, err := net.DefaultResolver.LookupTXT(ctx, hostname)
+	result, err := r.cfg.Lookuper.LookupTXT(ctx, hostname)
 
 	if err != nil {
 		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
-			return nil, nil
+			return TXTResult{}, nil
+		}
+
+		if errors.Is(err, ErrBogus) {
+			return TXTResult{Security: SecurityBogus}, err
+		}
+
+		var dnsErr *net.DNSError
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &dnsErr) && dnsErr.IsTimeout) {
+			return TXTResult{}, fmt.Errorf("%w: failed to lookup TXT records for %s: %w", ErrTimeout, hostname, err)
 		}
 
-		return nil, fmt.Errorf("failed to lookup TXT records for %s: %w", hostname, err)
+		return TXTResult{}, fmt.Errorf("%w: failed to lookup TXT records for %s: %w", ErrDNSFailure, hostname, err)
 	}
 
-	return records, nil
+	return result, nil
 }
 
-func (r *Resolver) getCached(l *slog.Logger, hostname string) (rr RR, ok bool) {
-	cached, ok := r.cache.Get(hostname)
+// getStale returns the cached entry for hostname if it can still be served stale.
+// Entries that failed to parse are never served stale
+func (r *Resolver) getStale(hostname string) (e entry, ok bool) {
+	if r.cfg.StaleWindow <= 0 {
+		return e, false
+	}
 
+	e, expiration, ok := r.cache.GetStale(hostname)
 	if !ok {
-		return rr, false
+		return e, false
 	}
 
-	// cast cached to RR
-	if val, ok := cached.(RR); !ok {
-		l.Error("invalid cached value, expected RR")
-		return rr, false
-	} else {
-		return val, true
+	if e.err != nil {
+		return e, false
 	}
+
+	if e.staleUntil.IsZero() {
+		e.staleUntil = expiration.Add(r.cfg.StaleWindow)
+	}
+
+	if r.cfg.Clock.Now().After(e.staleUntil) {
+		return e, false
+	}
+
+	return e, true
 }
 
-// parseCode parses the code string and returns the corresponding http status code
-func parseCode(code string) int {
+// markStale keeps the stale entry for hostname cached for staleAnswerTTL after a failed lookup,
+// so requests are answered without waiting on a failing upstream until the next attempt.
+// The entry does not slide, so it is looked up again once staleAnswerTTL has passed.
+// An entry that has not expired yet, e.g. after a failed prefetch, is left as it is
+func (r *Resolver) markStale(hostname string) {
+	if _, expiration, ok := r.cache.GetStale(hostname); ok && !r.cfg.Clock.Now().After(expiration) {
+		return
+	}
+
+	e, ok := r.getStale(hostname)
+	if !ok {
+		return
+	}
+
+	e.record.Stale = true
+	r.cache.SetFixed(hostname, e, min(staleAnswerTTL, r.cfg.Clock.Until(e.staleUntil)))
+}
+
+func (r *Resolver) getCached(hostname string) (e entry, ok bool) {
+	return r.cache.Get(hostname)
+}
+
+// srdRecords returns the TXT records that are srd records, other TXT records
+// published at the same name, e.g. for verification, are ignored
+func srdRecords(records []string) []string {
+	var srd []string
+
+	for _, record := range records {
+		if isSRDRecord(record) {
+			srd = append(srd, record)
+		}
+	}
+
+	return srd
+}
+
+// isSRDRecord reports whether a TXT record's first field is v=srd1.
+// The fields are read like parseRecord reads them, so records with a syntax error
+// after the version are still parsed and reported as invalid
+func isSRDRecord(record string) bool {
+	fields, _, _ := tokenizeRecord(record)
+
+	return len(fields) > 0 && fields[0].Key == "v" && fields[0].Value == VERSION
+}
+
+// parseCode parses the code string and returns the corresponding http status code,
+// or http.StatusFound and false for codes that aren't allowed
+func parseCode(code string) (int, bool) {
 	switch code {
 	case "301":
-		return http.StatusMovedPermanently
+		return http.StatusMovedPermanently, true
 	case "302":
-		return http.StatusFound
+		return http.StatusFound, true
 	case "307":
-		return http.StatusTemporaryRedirect
+		return http.StatusTemporaryRedirect, true
 	case "308":
-		return http.StatusPermanentRedirect
+		return http.StatusPermanentRedirect, true
 	default:
-		return http.StatusFound
+		return http.StatusFound, false
 	}
 }
 
-func parseRefererPolicy(policy string) RefererPolicy {
+// parseRefererPolicy parses the referer policy string,
+// returning DefaultRefererPolicy and false for unknown policies
+func parseRefererPolicy(policy string) (RefererPolicy, bool) {
 	switch policy {
 	case "none":
-		return RefererPolicyNone
+		return RefererPolicyNone, true
 	case "host":
-		return RefererPolicyHost
+		return RefererPolicyHost, true
 	case "full":
-		return RefererPolicyFull
+		return RefererPolicyFull, true
 	default:
-		return DefaultRefererPolicy
+		return DefaultRefererPolicy, false
+	}
+}
+
+// Invalidate drops the cached record for hostname so the next request looks it up again.
+// In peer mode the other replicas drop it too
+func (r *Resolver) Invalidate(hostname string) {
+	hostname = r.invalidate(hostname)
+
+	if r.peers != nil {
+		r.peers.invalidate(hostname)
 	}
 }
 
+// invalidate drops the cached record for hostname on this replica only
+func (r *Resolver) invalidate(hostname string) string {
+	hostname, _ = NormalizeHostname(hostname)
+
+	r.cache.Delete(hostname)
+	r.logger.Info("invalidated", "hostname", hostname)
+
+	return hostname
+}
+
+// Close stops the resolver's background work and saves a cache snapshot if configured
+func (r *Resolver) Close() error {
+	var err error
+
+	r.closeOnce.Do(func() {
+		close(r.done)
+
+		if r.cfg.SnapshotPath != "" {
+			err = r.saveSnapshot(r.cfg.SnapshotPath)
+		}
+
+		r.cache.Close()
+	})
+
+	return err
+}
+
 func (r *Resolver) Logger() *slog.Logger {
 	return r.logger
 }
@@ -374,3 +1109,13 @@ func (r *Resolver) Logger() *slog.Logger {
 func (r *Resolver) Config() *ResolverConfig {
 	return &r.cfg
 }
+
+// Upstreams returns the health of the lookup backend's upstream servers,
+// nil when the backend does not track them
+func (r *Resolver) Upstreams() []UpstreamHealth {
+	if reporter, ok := r.cfg.Lookuper.(HealthReporter); ok {
+		return reporter.Health()
+	}
+
+	return nil
+}
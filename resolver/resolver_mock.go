@@ -8,7 +8,10 @@ import (
 	"time"
 )
 
-type MockResolver struct{}
+type MockResolver struct {
+	// Invalidated are the hostnames passed to Invalidate
+	Invalidated []string
+}
 
 var MockData = map[string]RR{
 	"success": {
@@ -65,11 +68,32 @@ var MockData = map[string]RR{
 		RefererPolicy: RefererPolicyFull,
 		Code:          http.StatusFound,
 	},
+	"success-stale": {
+		Hostname:      "success-stale.test",
+		To:            "https://to.test/path?query=string",
+		NotFound:      false,
+		RefererPolicy: RefererPolicyHost,
+		Code:          http.StatusFound,
+		Stale:         true,
+	},
 	"invalid-to-url": {
 		Hostname: "invalid-to-url.test",
 		NotFound: true,
 		Code:     http.StatusNotFound,
 	},
+	"idn": {
+		Hostname: "xn--bcher-kva.test",
+		To:       "https://xn--caf-dma.test/Menu",
+		NotFound: false,
+		Code:     http.StatusFound,
+	},
+	"dnssec-secure": {
+		Hostname: "dnssec-secure.test",
+		To:       "https://to.test",
+		NotFound: false,
+		Code:     http.StatusFound,
+		Security: SecuritySecure,
+	},
 	"not-found": {
 		Hostname: "not-found.test",
 		NotFound: true,
@@ -85,6 +109,12 @@ var MockData = map[string]RR{
 
 var MockErrorHost = "error.test"
 var MockLoopHost = "loop.test"
+var MockInvalidHost = "invalid.test"
+var MockMultipleHost = "multiple.test"
+var MockDNSFailureHost = "dns-failure.test"
+var MockTimeoutHost = "timeout.test"
+var MockWarningsHost = "warnings.test"
+var MockBogusHost = "dnssec-bogus.test"
 
 func Mock() ResolverProvider {
 	return &MockResolver{}
@@ -99,13 +129,65 @@ func (r *MockResolver) Resolve(ctx context.Context, hostname string) (RR, error)
 		return RR{Hostname: hostname, To: "http://" + hostname, Code: 302}, ErrLoop
 	}
 
+	switch hostname {
+	case MockInvalidHost:
+		return RRNotFound, &InvalidRecordError{Err: fmt.Errorf("no destination found")}
+	case MockMultipleHost:
+		return RRNotFound, &InvalidRecordError{Err: fmt.Errorf("%w: found 2", ErrMultipleRecords)}
+	case MockDNSFailureHost:
+		return RR{}, fmt.Errorf("%w: server misbehaving", ErrDNSFailure)
+	case MockTimeoutHost:
+		return RR{}, fmt.Errorf("%w: i/o timeout", ErrTimeout)
+	case MockBogusHost:
+		rr := RRNotFound
+		rr.Security = SecurityBogus
+		return rr, &InvalidRecordError{Err: fmt.Errorf("%w: signature expired", ErrBogus)}
+	}
+
 	for _, rr := range MockData {
 		if rr.Hostname == hostname {
+			if rr.NotFound {
+				return rr, ErrNoRecord
+			}
+
 			return rr, nil
 		}
 	}
 
-	return RR{}, fmt.Errorf("not found")
+	return RRNotFound, ErrNoRecord
+}
+
+func (r *MockResolver) Inspect(ctx context.Context, hostname string) (Inspection, error) {
+	if hostname == MockWarningsHost {
+		return Inspection{
+			RR: RR{Hostname: hostname, To: "https://to.test", Code: http.StatusFound, RefererPolicy: RefererPolicyHost},
+			Warnings: []RecordWarning{
+				{Column: 35, Message: `invalid code "310", allowed values are 301, 302, 307 and 308, using 302`},
+			},
+		}, nil
+	}
+
+	rr, err := r.Resolve(ctx, hostname)
+	return Inspection{RR: rr}, err
+}
+
+func (r *MockResolver) Invalidate(hostname string) {
+	r.Invalidated = append(r.Invalidated, hostname)
+}
+
+func (r *MockResolver) Upstreams() []UpstreamHealth {
+	return []UpstreamHealth{
+		{Server: "10.0.0.53:53", Latency: time.Millisecond * 12, ErrorRate: 0.01, Queries: 100, Failures: 1},
+		{Server: "tls://10.0.0.54:853", Latency: time.Millisecond * 40, ErrorRate: 1, Queries: 5, Failures: 5, CircuitOpen: true, LastError: "i/o timeout"},
+	}
+}
+
+func (r *MockResolver) Close() error {
+	return nil
+}
+
+func (r *MockResolver) PeerHandler() http.Handler {
+	return http.NotFoundHandler()
 }
 
 func (r *MockResolver) Logger() *slog.Logger {
@@ -0,0 +1,181 @@
+package resolver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/twopow/srd/internal/clock"
+)
+
+// snapshotVersion is the version of the snapshot file format.
+// bump it when the format or RR changes, older snapshots are then discarded
+const snapshotVersion = 2
+
+// snapshot is the on disk form of the resolver cache
+type snapshot struct {
+	Version int             `json:"version"`
+	Created time.Time       `json:"created"`
+	Entries []snapshotEntry `json:"entries"`
+}
+
+type snapshotEntry struct {
+	Hostname string        `json:"hostname"`
+	Record   RR            `json:"record"`
+	Expires  time.Time     `json:"expires"`
+	TTL      time.Duration `json:"ttl"`
+
+	// StaleUntil is set for records that were being served stale
+	StaleUntil time.Time `json:"staleUntil,omitzero"`
+}
+
+// saveSnapshot writes the cached records to path, replacing it atomically.
+// invalid records are not saved, they are cheap to look up again
+func (r *Resolver) saveSnapshot(path string) error {
+	snap := snapshot{
+		Version: snapshotVersion,
+		Created: r.cfg.Clock.Now(),
+		Entries: []snapshotEntry{},
+	}
+
+	r.cache.Range(func(hostname string, e entry, expiration time.Time) bool {
+		if e.err != nil {
+			return true
+		}
+
+		se := snapshotEntry{
+			Hostname:   hostname,
+			Record:     e.record,
+			Expires:    e.expires,
+			TTL:        e.ttl,
+			StaleUntil: e.staleUntil,
+		}
+
+		// stale entries are re-cached briefly, keep the original expiry instead
+		se.Record.Stale = false
+
+		// negative entries do not track their own expiry
+		if se.Expires.IsZero() {
+			se.Expires = expiration
+		}
+
+		snap.Entries = append(snap.Entries, se)
+		return true
+	})
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache snapshot: %w", err)
+	}
+
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+
+	r.logger.Info("saved cache snapshot", "path", path, "entries", len(snap.Entries))
+	return nil
+}
+
+// loadSnapshot fills the cache from the snapshot at path, keeping the original expiry times.
+// records past their stale window are skipped, a missing snapshot or one
+// written by a different version is not an error
+func (r *Resolver) loadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to read cache snapshot: %w", err)
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("failed to decode cache snapshot: %w", err)
+	}
+
+	if snap.Version != snapshotVersion {
+		r.logger.Warn("discarding cache snapshot", "path", path, "version", snap.Version, "want", snapshotVersion)
+		return nil
+	}
+
+	now := r.cfg.Clock.Now()
+	loaded := 0
+
+	for _, se := range snap.Entries {
+		staleUntil := se.Expires.Add(r.cfg.StaleWindow)
+		if !se.StaleUntil.IsZero() {
+			staleUntil = se.StaleUntil
+		}
+
+		if !now.Before(staleUntil) {
+			continue
+		}
+
+		e := entry{
+			record:     se.Record,
+			staleUntil: se.StaleUntil,
+			ttl:        se.TTL,
+		}
+
+		if !se.Record.NotFound {
+			e.expires = se.Expires
+			e.hits = new(atomic.Int64)
+		}
+
+		// a negative ttl keeps the original expiry, so expired records are only served stale
+		if se.Record.NotFound {
+			r.cache.SetFixed(se.Hostname, e, se.Expires.Sub(now))
+		} else {
+			r.cache.SetWithTTL(se.Hostname, e, se.Expires.Sub(now))
+		}
+		loaded++
+	}
+
+	r.logger.Info("loaded cache snapshot", "path", path, "entries", loaded, "skipped", len(snap.Entries)-loaded)
+	return nil
+}
+
+// snapshotTimer periodically saves the cache until the resolver is closed
+func (r *Resolver) snapshotTimer(ticker clock.Ticker) {
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if err := r.saveSnapshot(r.cfg.SnapshotPath); err != nil {
+				r.logger.Error("failed to save cache snapshot", "error", err)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it into place,
+// so a crash mid write never leaves a truncated snapshot behind
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,197 @@
+package resolver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/twopow/srd/internal/clock"
+)
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	clk := clock.NewFake(time.Now())
+
+	lookuper := &fakeLookuper{
+		records: map[string][]string{"_srd.example.com": {"v=srd1; dest=https://example.net; code=301"}},
+		ttl:     time.Minute * 5,
+	}
+
+	withSnapshot := func(cfg *ResolverConfig) {
+		cfg.SnapshotPath = path
+		cfg.Clock = clk
+	}
+
+	r := newTestResolver(t, lookuper, withSnapshot)
+
+	if _, err := r.Resolve(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Resolve(context.Background(), "missing.example.com"); !errors.Is(err, ErrNoRecord) {
+		t.Fatal(err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	clk.Advance(time.Second * 30)
+
+	warm := newTestResolver(t, lookuper, withSnapshot)
+
+	rr, err := warm.Resolve(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.To != "https://example.net" || rr.Code != 301 {
+		t.Errorf("Resolve() = %v, want record from snapshot", rr)
+	}
+
+	if _, err := warm.Resolve(context.Background(), "missing.example.com"); !errors.Is(err, ErrNoRecord) {
+		t.Fatal(err)
+	}
+
+	if calls := lookuper.calls.Load(); calls != 2 {
+		t.Errorf("lookuper calls = %d, want 2 with a warm cache", calls)
+	}
+
+	// the original expiry is kept, not restarted at load
+	clk.Advance(time.Minute*4 + time.Second*40)
+
+	if _, err := warm.Resolve(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := lookuper.calls.Load(); calls != 3 {
+		t.Errorf("lookuper calls = %d, want 3 after the original ttl", calls)
+	}
+}
+
+func TestSnapshot_ExpiredServedStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	clk := clock.NewFake(time.Now())
+
+	lookuper := &fakeLookuper{
+		records: map[string][]string{"_srd.example.com": {"v=srd1; dest=https://example.net"}},
+		ttl:     time.Minute,
+	}
+
+	withSnapshot := func(cfg *ResolverConfig) {
+		cfg.SnapshotPath = path
+		cfg.StaleWindow = time.Hour
+		cfg.Clock = clk
+	}
+
+	r := newTestResolver(t, lookuper, withSnapshot)
+
+	if _, err := r.Resolve(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	clk.Advance(time.Minute * 10)
+	lookuper.err = &net.DNSError{Err: "server misbehaving", IsTemporary: true}
+
+	warm := newTestResolver(t, lookuper, withSnapshot)
+
+	rr, err := warm.Resolve(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("Resolve() error = %v, want stale record from snapshot", err)
+	}
+
+	if !rr.Stale {
+		t.Errorf("Resolve() = %v, want stale record", rr)
+	}
+
+	// past the stale window the record is dropped at load
+	clk.Advance(time.Hour)
+
+	cold := newTestResolver(t, lookuper, withSnapshot)
+	if n := cold.cache.Len(); n != 0 {
+		t.Errorf("cache entries = %d, want 0 past the stale window", n)
+	}
+}
+
+func TestSnapshot_VersionMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	data, err := json.Marshal(snapshot{
+		Version: snapshotVersion + 1,
+		Entries: []snapshotEntry{{
+			Hostname: "example.com",
+			Record:   RR{Hostname: "example.com", To: "https://example.net"},
+			Expires:  time.Now().Add(time.Hour),
+		}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestResolver(t, &fakeLookuper{}, func(cfg *ResolverConfig) {
+		cfg.SnapshotPath = path
+	})
+
+	if n := r.cache.Len(); n != 0 {
+		t.Errorf("cache entries = %d, want snapshot of another version discarded", n)
+	}
+}
+
+func TestSnapshot_Missing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	r := newTestResolver(t, &fakeLookuper{}, func(cfg *ResolverConfig) {
+		cfg.SnapshotPath = path
+	})
+
+	if err := r.loadSnapshot(path); err != nil {
+		t.Errorf("loadSnapshot() error = %v, want nil for a missing snapshot", err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("snapshot not written on close: %v", err)
+	}
+}
+
+func TestSnapshot_Periodic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	clk := clock.NewFake(time.Now())
+
+	newTestResolver(t, &fakeLookuper{}, func(cfg *ResolverConfig) {
+		cfg.SnapshotPath = path
+		cfg.SnapshotInterval = time.Minute
+		cfg.Clock = clk
+	})
+
+	clk.Advance(time.Minute)
+
+	// the snapshot goroutine runs on its own, wait for it to catch up
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Error("snapshot not written after the snapshot interval")
+}